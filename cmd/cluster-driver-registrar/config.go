@@ -0,0 +1,153 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/ghodss/yaml"
+	k8scsi "k8s.io/csi-api/pkg/apis/csi/v1alpha1"
+)
+
+// Config contains the settings for the CSIDriver object. It can be
+// loaded from the file given with --config. Command line flags take
+// precedence over values from the file.
+type Config struct {
+	// DriverName corresponds to --driver-name-override.
+	DriverName string `json:"driverName,omitempty"`
+	// PodInfoOnMountVersion corresponds to --pod-info-mount-version.
+	PodInfoOnMountVersion string `json:"podInfoOnMountVersion,omitempty"`
+	// Labels are merged with --label. Flags win for keys set in both.
+	Labels map[string]string `json:"labels,omitempty"`
+	// Annotations are merged with --annotation. Flags win for keys set
+	// in both.
+	Annotations map[string]string `json:"annotations,omitempty"`
+	// ExtraSpec is the JSON object from --extra-spec-json. It is not
+	// read from the file.
+	ExtraSpec string `json:"-"`
+}
+
+// loadConfig reads and validates a YAML configuration file. Unknown
+// fields are rejected to catch typos.
+func loadConfig(path string) (*Config, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	jsonData, err := yaml.YAMLToJSON(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	config := &Config{}
+	decoder := json.NewDecoder(bytes.NewReader(jsonData))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(config); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	if err := config.validate(); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return config, nil
+}
+
+// validate checks the values that can be checked without talking to
+// the CSI driver.
+func (c *Config) validate() error {
+	if c.DriverName != "" {
+		if err := validateDriverName(c.DriverName); err != nil {
+			return err
+		}
+	}
+	if err := validateLabels(c.Labels); err != nil {
+		return err
+	}
+	return validateAnnotations(c.Annotations)
+}
+
+// mergeConfig combines the configuration from the file with the one
+// from the command line. flagsSet contains the names of the flags that
+// were given explicitly; only those override values from the file.
+func mergeConfig(file, flags *Config, flagsSet map[string]bool) *Config {
+	merged := *flags
+	if file == nil {
+		return &merged
+	}
+	if !flagsSet["driver-name-override"] {
+		merged.DriverName = file.DriverName
+	}
+	if !flagsSet["pod-info-mount-version"] {
+		merged.PodInfoOnMountVersion = file.PodInfoOnMountVersion
+	}
+	merged.Labels = mergeMap(file.Labels, flags.Labels)
+	merged.Annotations = mergeMap(file.Annotations, flags.Annotations)
+	return &merged
+}
+
+// applyExtraSpec merges the fields of the JSON object from
+// --extra-spec-json into the spec, with the semantics of a JSON merge
+// patch. Fields which the vendored CSIDriver API does not have cannot
+// be stored. They are returned sorted by name, or cause an error if
+// strict is set.
+func applyExtraSpec(spec *k8scsi.CSIDriverSpec, extraSpec string, strict bool) ([]string, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(extraSpec), &fields); err != nil {
+		return nil, fmt.Errorf("not a JSON object: %v", err)
+	}
+	if _, ok := fields["attachRequired"]; ok {
+		return nil, fmt.Errorf("attachRequired is determined by asking the CSI driver and cannot be set")
+	}
+	known := specFieldNames()
+	var unknown []string
+	for name := range fields {
+		if !known[name] {
+			unknown = append(unknown, name)
+			delete(fields, name)
+		}
+	}
+	sort.Strings(unknown)
+	if strict && len(unknown) > 0 {
+		return nil, fmt.Errorf("not supported by the %s CSIDriver API: %s", k8scsi.SchemeGroupVersion, strings.Join(unknown, ", "))
+	}
+	data, err := json.Marshal(fields)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, spec); err != nil {
+		return nil, err
+	}
+	return unknown, nil
+}
+
+// specFieldNames returns the JSON names of all fields in the
+// CSIDriver spec.
+func specFieldNames() map[string]bool {
+	names := map[string]bool{}
+	specType := reflect.TypeOf(k8scsi.CSIDriverSpec{})
+	for i := 0; i < specType.NumField(); i++ {
+		name := strings.Split(specType.Field(i).Tag.Get("json"), ",")[0]
+		if name != "" && name != "-" {
+			names[name] = true
+		}
+	}
+	return names
+}
@@ -0,0 +1,238 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	k8scsi "k8s.io/csi-api/pkg/apis/csi/v1alpha1"
+)
+
+func TestLoadConfig(t *testing.T) {
+	tests := []struct {
+		name           string
+		content        string
+		expectError    bool
+		expectedConfig *Config
+	}{
+		{
+			name: "all fields",
+			content: `
+driverName: csi.example.com
+podInfoOnMountVersion: v1
+labels:
+  team: storage
+annotations:
+  example.com/note: hello world
+`,
+			expectedConfig: &Config{
+				DriverName:            "csi.example.com",
+				PodInfoOnMountVersion: "v1",
+				Labels:                map[string]string{"team": "storage"},
+				Annotations:           map[string]string{"example.com/note": "hello world"},
+			},
+		},
+		{
+			name:           "empty",
+			content:        "",
+			expectedConfig: &Config{},
+		},
+		{
+			name:        "unknown field",
+			content:     "driverNmae: csi.example.com\n",
+			expectError: true,
+		},
+		{
+			name:        "invalid driver name",
+			content:     "driverName: CSI_Example\n",
+			expectError: true,
+		},
+		{
+			name:        "invalid label",
+			content:     "labels:\n  team: \"not valid!\"\n",
+			expectError: true,
+		},
+		{
+			name:        "invalid YAML",
+			content:     "labels: [\n",
+			expectError: true,
+		},
+	}
+
+	dir, err := ioutil.TempDir("", "cluster-driver-registrar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, test := range tests {
+		path := filepath.Join(dir, "config.yaml")
+		if err := ioutil.WriteFile(path, []byte(test.content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		config, err := loadConfig(path)
+		if test.expectError && err == nil {
+			t.Errorf("test %q: Expected error, got none", test.name)
+		}
+		if !test.expectError && err != nil {
+			t.Errorf("test %q: got error: %v", test.name, err)
+		}
+		if test.expectedConfig != nil && !reflect.DeepEqual(config, test.expectedConfig) {
+			t.Errorf("test %q: expected config %+v, got %+v", test.name, test.expectedConfig, config)
+		}
+	}
+
+	if _, err := loadConfig(filepath.Join(dir, "no-such-file.yaml")); err == nil {
+		t.Errorf("missing file: Expected error, got none")
+	}
+}
+
+func TestMergeConfig(t *testing.T) {
+	file := &Config{
+		DriverName:            "file.example.com",
+		PodInfoOnMountVersion: "v1",
+		Labels:                map[string]string{"team": "file", "tier": "file"},
+	}
+	tests := []struct {
+		name           string
+		file           *Config
+		flags          *Config
+		flagsSet       map[string]bool
+		expectedConfig *Config
+	}{
+		{
+			name:           "no file",
+			flags:          &Config{DriverName: "flag.example.com"},
+			expectedConfig: &Config{DriverName: "flag.example.com"},
+		},
+		{
+			name:  "file only",
+			file:  file,
+			flags: &Config{},
+			expectedConfig: &Config{
+				DriverName:            "file.example.com",
+				PodInfoOnMountVersion: "v1",
+				Labels:                map[string]string{"team": "file", "tier": "file"},
+			},
+		},
+		{
+			name: "flags take precedence",
+			file: file,
+			flags: &Config{
+				DriverName: "flag.example.com",
+				Labels:     map[string]string{"team": "flag"},
+			},
+			flagsSet: map[string]bool{"driver-name-override": true, "pod-info-mount-version": true},
+			expectedConfig: &Config{
+				DriverName: "flag.example.com",
+				Labels:     map[string]string{"team": "flag", "tier": "file"},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		config := mergeConfig(test.file, test.flags, test.flagsSet)
+		if !reflect.DeepEqual(config, test.expectedConfig) {
+			t.Errorf("test %q: expected config %+v, got %+v", test.name, test.expectedConfig, config)
+		}
+	}
+}
+
+func TestApplyExtraSpec(t *testing.T) {
+	tests := []struct {
+		name            string
+		extraSpec       string
+		strict          bool
+		expectError     bool
+		expectedVersion *string
+		expectedUnknown []string
+	}{
+		{
+			name:            "known field",
+			extraSpec:       `{"podInfoOnMountVersion": "v1"}`,
+			expectedVersion: stringPtr("v1"),
+		},
+		{
+			name:            "null removes field",
+			extraSpec:       `{"podInfoOnMountVersion": null}`,
+			expectedVersion: nil,
+		},
+		{
+			name:            "unknown fields",
+			extraSpec:       `{"seLinuxMount": true, "nodeAllocatableUpdatePeriodSeconds": 60}`,
+			expectedVersion: stringPtr(""),
+			expectedUnknown: []string{"nodeAllocatableUpdatePeriodSeconds", "seLinuxMount"},
+		},
+		{
+			name:        "unknown fields strict",
+			extraSpec:   `{"seLinuxMount": true}`,
+			strict:      true,
+			expectError: true,
+		},
+		{
+			name:        "attachRequired",
+			extraSpec:   `{"attachRequired": false}`,
+			expectError: true,
+		},
+		{
+			name:        "not an object",
+			extraSpec:   `[1]`,
+			expectError: true,
+		},
+		{
+			name:        "wrong type",
+			extraSpec:   `{"podInfoOnMountVersion": 1}`,
+			expectError: true,
+		},
+	}
+
+	for _, test := range tests {
+		attachRequired := true
+		spec := k8scsi.CSIDriverSpec{
+			AttachRequired:        &attachRequired,
+			PodInfoOnMountVersion: stringPtr(""),
+		}
+		unknown, err := applyExtraSpec(&spec, test.extraSpec, test.strict)
+		if test.expectError {
+			if err == nil {
+				t.Errorf("test %q: Expected error, got none", test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("test %q: got error: %v", test.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(spec.PodInfoOnMountVersion, test.expectedVersion) {
+			t.Errorf("test %q: expected podInfoOnMountVersion %v, got %v", test.name, stringPtrString(test.expectedVersion), stringPtrString(spec.PodInfoOnMountVersion))
+		}
+		if spec.AttachRequired == nil || !*spec.AttachRequired {
+			t.Errorf("test %q: attachRequired was modified", test.name)
+		}
+		if !reflect.DeepEqual(unknown, test.expectedUnknown) {
+			t.Errorf("test %q: expected unknown fields %v, got %v", test.name, test.expectedUnknown, unknown)
+		}
+	}
+}
+
+func stringPtr(s string) *string {
+	return &s
+}
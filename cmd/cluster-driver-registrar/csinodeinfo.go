@@ -0,0 +1,114 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/rest"
+	k8scsi "k8s.io/csi-api/pkg/apis/csi/v1alpha1"
+	k8scsiclient "k8s.io/csi-api/pkg/client/clientset/versioned"
+	k8scsiclientv1alpha1 "k8s.io/csi-api/pkg/client/clientset/versioned/typed/csi/v1alpha1"
+)
+
+// csiNodeInfoAvailable checks whether the API server serves the alpha
+// CSINodeInfo resource.
+func csiNodeInfoAvailable(client discovery.ServerResourcesInterface) (bool, error) {
+	return resourceAvailable(client, k8scsi.SchemeGroupVersion.String(), k8scsi.CsiNodeInfoResourcePlural)
+}
+
+// csiNodeInfoUpdater stores node IDs in the CSINodeInfo object of the
+// node.
+type csiNodeInfoUpdater struct {
+	csiNodeInfos k8scsiclientv1alpha1.CSINodeInfoInterface
+}
+
+var (
+	_ nodeIDUpdater = &csiNodeInfoUpdater{}
+)
+
+func newCSINodeInfoUpdater(config *rest.Config) (nodeIDUpdater, error) {
+	clientset, err := k8scsiclient.NewForConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	return &csiNodeInfoUpdater{csiNodeInfos: clientset.CsiV1alpha1().CSINodeInfos()}, nil
+}
+
+func (u *csiNodeInfoUpdater) UpdateNodeID(nodeName, driverName, nodeID string) error {
+	// Other drivers are listed in the same object, so retry with the
+	// latest content on conflicts.
+	return retryOnError(registerBackoff, isRetriable, func() error {
+		info, err := u.csiNodeInfos.Get(nodeName, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			info = &k8scsi.CSINodeInfo{
+				ObjectMeta: metav1.ObjectMeta{Name: nodeName},
+			}
+			setCSINodeInfoDriver(info, driverName, nodeID)
+			_, err := u.csiNodeInfos.Create(info)
+			return err
+		} else if err != nil {
+			return err
+		}
+		if !setCSINodeInfoDriver(info, driverName, nodeID) {
+			return nil
+		}
+		_, err = u.csiNodeInfos.Update(info)
+		return err
+	})
+}
+
+// setCSINodeInfoDriver sets the node ID of the driver in the object and
+// returns whether that changed it. Topology keys of an existing entry
+// are kept.
+func setCSINodeInfoDriver(info *k8scsi.CSINodeInfo, driverName, nodeID string) bool {
+	for i := range info.CSIDrivers {
+		driver := &info.CSIDrivers[i]
+		if driver.Driver == driverName {
+			if driver.NodeID == nodeID {
+				return false
+			}
+			driver.NodeID = nodeID
+			return true
+		}
+	}
+	info.CSIDrivers = append(info.CSIDrivers, k8scsi.CSIDriverInfo{
+		Driver:       driverName,
+		NodeID:       nodeID,
+		TopologyKeys: []string{},
+	})
+	return true
+}
+
+// nodeIDUpdaters stores the node ID with all of the updaters.
+type nodeIDUpdaters []nodeIDUpdater
+
+var (
+	_ nodeIDUpdater = nodeIDUpdaters{}
+)
+
+func (updaters nodeIDUpdaters) UpdateNodeID(nodeName, driverName, nodeID string) error {
+	var errs []error
+	for _, updater := range updaters {
+		if err := updater.UpdateNodeID(nodeName, driverName, nodeID); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return utilerrors.NewAggregate(errs)
+}
@@ -0,0 +1,175 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/rest"
+	k8scsi "k8s.io/csi-api/pkg/apis/csi/v1alpha1"
+)
+
+func TestSetCSINodeInfoDriver(t *testing.T) {
+	tests := []struct {
+		name            string
+		drivers         []k8scsi.CSIDriverInfo
+		expectedChanged bool
+		expectedDrivers []k8scsi.CSIDriverInfo
+	}{
+		{
+			name:            "new entry",
+			expectedChanged: true,
+			expectedDrivers: []k8scsi.CSIDriverInfo{
+				{Driver: "csi.example.com", NodeID: "node-1", TopologyKeys: []string{}},
+			},
+		},
+		{
+			name: "other driver",
+			drivers: []k8scsi.CSIDriverInfo{
+				{Driver: "other.example.com", NodeID: "x"},
+			},
+			expectedChanged: true,
+			expectedDrivers: []k8scsi.CSIDriverInfo{
+				{Driver: "other.example.com", NodeID: "x"},
+				{Driver: "csi.example.com", NodeID: "node-1", TopologyKeys: []string{}},
+			},
+		},
+		{
+			name: "unchanged",
+			drivers: []k8scsi.CSIDriverInfo{
+				{Driver: "csi.example.com", NodeID: "node-1", TopologyKeys: []string{"zone"}},
+			},
+			expectedDrivers: []k8scsi.CSIDriverInfo{
+				{Driver: "csi.example.com", NodeID: "node-1", TopologyKeys: []string{"zone"}},
+			},
+		},
+		{
+			name: "node ID changed",
+			drivers: []k8scsi.CSIDriverInfo{
+				{Driver: "csi.example.com", NodeID: "old", TopologyKeys: []string{"zone"}},
+			},
+			expectedChanged: true,
+			expectedDrivers: []k8scsi.CSIDriverInfo{
+				{Driver: "csi.example.com", NodeID: "node-1", TopologyKeys: []string{"zone"}},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		info := &k8scsi.CSINodeInfo{CSIDrivers: test.drivers}
+		changed := setCSINodeInfoDriver(info, "csi.example.com", "node-1")
+		if changed != test.expectedChanged {
+			t.Errorf("test %q: expected changed %t, got %t", test.name, test.expectedChanged, changed)
+		}
+		if !reflect.DeepEqual(info.CSIDrivers, test.expectedDrivers) {
+			t.Errorf("test %q: expected drivers %+v, got %+v", test.name, test.expectedDrivers, info.CSIDrivers)
+		}
+	}
+}
+
+// recordingNodeIDUpdater remembers the node IDs it was called with.
+type recordingNodeIDUpdater struct {
+	nodeIDs []string
+	err     error
+}
+
+func (r *recordingNodeIDUpdater) UpdateNodeID(nodeName, driverName, nodeID string) error {
+	r.nodeIDs = append(r.nodeIDs, nodeID)
+	return r.err
+}
+
+func TestNodeIDUpdaters(t *testing.T) {
+	failing := &recordingNodeIDUpdater{err: fmt.Errorf("mock error")}
+	working := &recordingNodeIDUpdater{}
+	updaters := nodeIDUpdaters{failing, working}
+
+	if err := updaters.UpdateNodeID("node", "csi.example.com", "node-1"); err == nil {
+		t.Error("Expected error, got none")
+	}
+	// A failing updater must not prevent the others from running.
+	for i, updater := range []*recordingNodeIDUpdater{failing, working} {
+		if !reflect.DeepEqual(updater.nodeIDs, []string{"node-1"}) {
+			t.Errorf("updater #%d: expected one call, got %v", i, updater.nodeIDs)
+		}
+	}
+}
+
+func TestCSINodeInfoAvailable(t *testing.T) {
+	tests := []struct {
+		name        string
+		resources   []string
+		status      int
+		expectError bool
+		expected    bool
+	}{
+		{
+			name:      "available",
+			resources: []string{"csidrivers", "csinodeinfos"},
+			expected:  true,
+		},
+		{
+			name:      "only CSIDriver",
+			resources: []string{"csidrivers"},
+		},
+		{
+			name:   "group not served",
+			status: http.StatusNotFound,
+		},
+		{
+			name:        "server error",
+			status:      http.StatusForbidden,
+			expectError: true,
+		},
+	}
+
+	for _, test := range tests {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if test.status != 0 {
+				w.WriteHeader(test.status)
+				return
+			}
+			list := metav1.APIResourceList{GroupVersion: k8scsi.SchemeGroupVersion.String()}
+			for _, resource := range test.resources {
+				list.APIResources = append(list.APIResources, metav1.APIResource{Name: resource})
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(list)
+		}))
+		client, err := discovery.NewDiscoveryClientForConfig(&rest.Config{Host: server.URL})
+		if err != nil {
+			t.Fatal(err)
+		}
+		available, err := csiNodeInfoAvailable(client)
+		server.Close()
+		if test.expectError && err == nil {
+			t.Errorf("test %q: Expected error, got none", test.name)
+		}
+		if !test.expectError && err != nil {
+			t.Errorf("test %q: got error: %v", test.name, err)
+		}
+		if available != test.expected {
+			t.Errorf("test %q: expected available %t, got %t", test.name, test.expected, available)
+		}
+	}
+}
@@ -0,0 +1,86 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+)
+
+// errorClass tells why run failed.
+type errorClass string
+
+const (
+	// The command line flags or configuration files are invalid.
+	validationFailure errorClass = "validation"
+	// The CSI driver or the API server could not be reached.
+	connectionFailure errorClass = "connection"
+	// The CSI driver or the API server responded, but with something
+	// the registrar cannot work with.
+	discoveryFailure errorClass = "discovery"
+	// The API server refused a request because of missing
+	// permissions.
+	rbacFailure errorClass = "RBAC"
+)
+
+// startupError is an error with a class. The message is the one of the
+// wrapped error, so classifying an error does not change what users
+// see.
+type startupError struct {
+	class errorClass
+	err   error
+}
+
+func (e *startupError) Error() string {
+	return e.err.Error()
+}
+
+// classify wraps err unless it is nil or already has a class.
+func classify(class errorClass, err error) error {
+	if err == nil {
+		return nil
+	}
+	if _, ok := err.(*startupError); ok {
+		return err
+	}
+	return &startupError{class: class, err: err}
+}
+
+// validationErrorf creates an error for invalid flags or
+// configuration.
+func validationErrorf(format string, args ...interface{}) error {
+	return &startupError{class: validationFailure, err: fmt.Errorf(format, args...)}
+}
+
+// apiError classifies an error from the API server as RBAC failure if
+// the request was forbidden and with the given class otherwise.
+func apiError(class errorClass, err error) error {
+	if apierrors.IsForbidden(err) {
+		return classify(rbacFailure, err)
+	}
+	return classify(class, err)
+}
+
+// errorClassOf returns the class of err, or an empty string for
+// unclassified errors.
+func errorClassOf(err error) errorClass {
+	if e, ok := err.(*startupError); ok {
+		return e.class
+	}
+	return ""
+}
@@ -0,0 +1,132 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	k8scsi "k8s.io/csi-api/pkg/apis/csi/v1alpha1"
+)
+
+func TestClassify(t *testing.T) {
+	forbidden := apierrors.NewForbidden(k8scsi.Resource(k8scsi.CsiDriverResourcePlural), "csi.example.com", fmt.Errorf("mock error"))
+	tests := []struct {
+		name          string
+		err           error
+		expectedClass errorClass
+	}{
+		{
+			name: "unclassified",
+			err:  fmt.Errorf("mock error"),
+		},
+		{
+			name:          "classified",
+			err:           classify(connectionFailure, fmt.Errorf("mock error")),
+			expectedClass: connectionFailure,
+		},
+		{
+			name:          "classified twice",
+			err:           classify(discoveryFailure, classify(connectionFailure, fmt.Errorf("mock error"))),
+			expectedClass: connectionFailure,
+		},
+		{
+			name:          "validation",
+			err:           validationErrorf("--flag: %v", "mock error"),
+			expectedClass: validationFailure,
+		},
+		{
+			name:          "forbidden",
+			err:           apiError(connectionFailure, forbidden),
+			expectedClass: rbacFailure,
+		},
+		{
+			name:          "other API error",
+			err:           apiError(connectionFailure, apierrors.NewTimeoutError("mock error", 0)),
+			expectedClass: connectionFailure,
+		},
+	}
+
+	for _, test := range tests {
+		if class := errorClassOf(test.err); class != test.expectedClass {
+			t.Errorf("test %q: expected class %q, got %q", test.name, test.expectedClass, class)
+		}
+	}
+	if classify(validationFailure, nil) != nil {
+		t.Error("expected nil for nil error")
+	}
+	if err := classify(connectionFailure, fmt.Errorf("mock error")); err.Error() != "mock error" {
+		t.Errorf("expected unchanged message, got %q", err.Error())
+	}
+}
+
+func TestRun(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cluster-driver-registrar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	missingSocket := filepath.Join(dir, "csi.sock")
+
+	tests := []struct {
+		name          string
+		resyncPeriod  time.Duration
+		addresses     stringListFlag
+		expectedClass errorClass
+	}{
+		{
+			name:          "invalid flag",
+			resyncPeriod:  0,
+			expectedClass: validationFailure,
+		},
+		{
+			name:          "invalid address",
+			resyncPeriod:  time.Minute,
+			addresses:     stringListFlag{"no-port"},
+			expectedClass: validationFailure,
+		},
+		{
+			name:          "no driver",
+			resyncPeriod:  time.Minute,
+			addresses:     stringListFlag{missingSocket},
+			expectedClass: connectionFailure,
+		},
+	}
+
+	defer func(period time.Duration) { *resyncPeriod = period }(*resyncPeriod)
+	defer func(timeout time.Duration) { *connectionRetryTimeout = timeout }(*connectionRetryTimeout)
+	defer func(addresses stringListFlag) { csiAddresses = addresses }(csiAddresses)
+	*connectionRetryTimeout = 0
+
+	for _, test := range tests {
+		*resyncPeriod = test.resyncPeriod
+		csiAddresses = test.addresses
+		err := run()
+		if err == nil {
+			t.Errorf("test %q: Expected error, got none", test.name)
+			continue
+		}
+		if class := errorClassOf(err); class != test.expectedClass {
+			t.Errorf("test %q: expected class %q, got %q: %v", test.name, test.expectedClass, class, err)
+		}
+	}
+}
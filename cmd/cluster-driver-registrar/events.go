@@ -0,0 +1,145 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/golang/glog"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/rest"
+	k8scsi "k8s.io/csi-api/pkg/apis/csi/v1alpha1"
+)
+
+// Component name in the source of events and in the default user
+// agent for the Kubernetes API.
+const componentName = "csi-cluster-driver-registrar"
+
+// eventRecorder records events about a CSIDriver object.
+type eventRecorder interface {
+	Event(csiDriver *k8scsi.CSIDriver, eventType, reason, message string)
+}
+
+// apiEventRecorder creates Event objects in the Kubernetes API server.
+// CSIDriver objects are not namespaced, so all events are stored in
+// the same namespace.
+type apiEventRecorder struct {
+	client    rest.Interface
+	namespace string
+}
+
+var (
+	_ eventRecorder = &apiEventRecorder{}
+)
+
+func newAPIEventRecorder(config *rest.Config, namespace string) (eventRecorder, error) {
+	client, err := newCoreRESTClient(config)
+	if err != nil {
+		return nil, err
+	}
+	return &apiEventRecorder{
+		client:    client,
+		namespace: namespace,
+	}, nil
+}
+
+func (r *apiEventRecorder) Event(csiDriver *k8scsi.CSIDriver, eventType, reason, message string) {
+	now := metav1.Now()
+	event := &corev1.Event{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      fmt.Sprintf("%s.%x", csiDriver.Name, now.UnixNano()),
+			Namespace: r.namespace,
+		},
+		InvolvedObject: corev1.ObjectReference{
+			APIVersion: k8scsi.SchemeGroupVersion.String(),
+			Kind:       "CSIDriver",
+			Name:       csiDriver.Name,
+			UID:        csiDriver.UID,
+		},
+		Reason:         reason,
+		Message:        message,
+		Source:         corev1.EventSource{Component: componentName},
+		FirstTimestamp: now,
+		LastTimestamp:  now,
+		Count:          1,
+		Type:           eventType,
+	}
+	err := r.client.Post().
+		Namespace(r.namespace).
+		Resource("events").
+		Body(event).
+		Timeout(10 * time.Second).
+		Do().
+		Error()
+	if err != nil {
+		glog.Warningf("Failed to record event %s for CSIDriver %s: %v", reason, csiDriver.Name, err)
+	}
+}
+
+// eventingRegistrar records an event for each modification of a
+// CSIDriver object.
+type eventingRegistrar struct {
+	Registrar
+	recorder eventRecorder
+}
+
+var (
+	_ Registrar = &eventingRegistrar{}
+)
+
+func (r *eventingRegistrar) Create(csiDriver *k8scsi.CSIDriver) (*k8scsi.CSIDriver, error) {
+	created, err := r.Registrar.Create(csiDriver)
+	if err != nil {
+		r.recorder.Event(csiDriver, corev1.EventTypeWarning, "RegistrationFailed",
+			fmt.Sprintf("Failed to register CSI driver %s: %v", csiDriver.Name, err))
+		return nil, err
+	}
+	r.recorder.Event(created, corev1.EventTypeNormal, "Registered",
+		fmt.Sprintf("Registered CSI driver %s", csiDriver.Name))
+	return created, nil
+}
+
+func (r *eventingRegistrar) Update(csiDriver *k8scsi.CSIDriver) (*k8scsi.CSIDriver, error) {
+	updated, err := r.Registrar.Update(csiDriver)
+	if err != nil {
+		r.recorder.Event(csiDriver, corev1.EventTypeWarning, "UpdateFailed",
+			fmt.Sprintf("Failed to update CSI driver %s: %v", csiDriver.Name, err))
+		return nil, err
+	}
+	r.recorder.Event(updated, corev1.EventTypeNormal, "Updated",
+		fmt.Sprintf("Updated CSI driver %s", csiDriver.Name))
+	return updated, nil
+}
+
+func (r *eventingRegistrar) Delete(name string) error {
+	csiDriver := &k8scsi.CSIDriver{ObjectMeta: metav1.ObjectMeta{Name: name}}
+	err := r.Registrar.Delete(name)
+	if apierrors.IsNotFound(err) {
+		// Nothing was deregistered.
+		return err
+	} else if err != nil {
+		r.recorder.Event(csiDriver, corev1.EventTypeWarning, "DeregistrationFailed",
+			fmt.Sprintf("Failed to deregister CSI driver %s: %v", name, err))
+		return err
+	}
+	r.recorder.Event(csiDriver, corev1.EventTypeNormal, "Deregistered",
+		fmt.Sprintf("Deregistered CSI driver %s", name))
+	return nil
+}
@@ -0,0 +1,110 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	k8scsi "k8s.io/csi-api/pkg/apis/csi/v1alpha1"
+)
+
+// fakeEventRecorder remembers the type and reason of all events.
+type fakeEventRecorder struct {
+	events []string
+}
+
+func (r *fakeEventRecorder) Event(csiDriver *k8scsi.CSIDriver, eventType, reason, message string) {
+	r.events = append(r.events, eventType+" "+reason)
+}
+
+func TestEventingRegistrar(t *testing.T) {
+	tests := []struct {
+		name           string
+		existing       []*k8scsi.CSIDriver
+		createErr      error
+		deleteErr      error
+		op             func(r Registrar) error
+		expectedEvents []string
+	}{
+		{
+			name: "create",
+			op: func(r Registrar) error {
+				_, err := r.Create(makeCSIDriver("csi.example.com", true, nil))
+				return err
+			},
+			expectedEvents: []string{corev1.EventTypeNormal + " Registered"},
+		},
+		{
+			name:      "create error",
+			createErr: fmt.Errorf("mock error"),
+			op: func(r Registrar) error {
+				_, err := r.Create(makeCSIDriver("csi.example.com", true, nil))
+				return err
+			},
+			expectedEvents: []string{corev1.EventTypeWarning + " RegistrationFailed"},
+		},
+		{
+			name:     "update",
+			existing: []*k8scsi.CSIDriver{makeCSIDriver("csi.example.com", false, nil)},
+			op: func(r Registrar) error {
+				_, err := r.Update(makeCSIDriver("csi.example.com", true, nil))
+				return err
+			},
+			expectedEvents: []string{corev1.EventTypeNormal + " Updated"},
+		},
+		{
+			name:     "delete",
+			existing: []*k8scsi.CSIDriver{makeCSIDriver("csi.example.com", true, nil)},
+			op: func(r Registrar) error {
+				return r.Delete("csi.example.com")
+			},
+			expectedEvents: []string{corev1.EventTypeNormal + " Deregistered"},
+		},
+		{
+			name: "delete not found",
+			op: func(r Registrar) error {
+				r.Delete("csi.example.com")
+				return nil
+			},
+		},
+		{
+			name:      "delete error",
+			existing:  []*k8scsi.CSIDriver{makeCSIDriver("csi.example.com", true, nil)},
+			deleteErr: fmt.Errorf("mock error"),
+			op: func(r Registrar) error {
+				return r.Delete("csi.example.com")
+			},
+			expectedEvents: []string{corev1.EventTypeWarning + " DeregistrationFailed"},
+		},
+	}
+
+	for _, test := range tests {
+		fake := newFakeRegistrar(test.existing...)
+		fake.createErr = test.createErr
+		fake.deleteErr = test.deleteErr
+		recorder := &fakeEventRecorder{}
+		registrar := &eventingRegistrar{Registrar: fake, recorder: recorder}
+
+		test.op(registrar)
+		if !reflect.DeepEqual(recorder.events, test.expectedEvents) {
+			t.Errorf("test %q: expected events %v, got %v", test.name, test.expectedEvents, recorder.events)
+		}
+	}
+}
@@ -0,0 +1,164 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/golang/glog"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/apimachinery/pkg/util/validation"
+	k8scsi "k8s.io/csi-api/pkg/apis/csi/v1alpha1"
+)
+
+// keyValueFlag is a repeatable command line flag of the form key=value.
+type keyValueFlag map[string]string
+
+var (
+	_ flag.Value = keyValueFlag{}
+)
+
+func (kv keyValueFlag) String() string {
+	var pairs []string
+	for key, value := range kv {
+		pairs = append(pairs, key+"="+value)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+func (kv keyValueFlag) Set(pair string) error {
+	parts := strings.SplitN(pair, "=", 2)
+	if len(parts) != 2 || parts[0] == "" {
+		return fmt.Errorf("%q is not of the form key=value", pair)
+	}
+	if _, ok := kv[parts[0]]; ok {
+		return fmt.Errorf("key %q specified more than once", parts[0])
+	}
+	kv[parts[0]] = parts[1]
+	return nil
+}
+
+// stringListFlag is a repeatable command line flag which collects all
+// values.
+type stringListFlag []string
+
+var (
+	_ flag.Value = &stringListFlag{}
+)
+
+func (l *stringListFlag) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringListFlag) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+// validateLabels checks keys and values against the Kubernetes label
+// syntax.
+func validateLabels(labels map[string]string) error {
+	for key, value := range labels {
+		if errs := validation.IsQualifiedName(key); len(errs) > 0 {
+			return fmt.Errorf("invalid label key %q: %s", key, strings.Join(errs, ", "))
+		}
+		if errs := validation.IsValidLabelValue(value); len(errs) > 0 {
+			return fmt.Errorf("invalid value %q for label %q: %s", value, key, strings.Join(errs, ", "))
+		}
+	}
+	return nil
+}
+
+// validateAnnotations checks the annotation keys. Values can be
+// arbitrary strings.
+func validateAnnotations(annotations map[string]string) error {
+	for key := range annotations {
+		if errs := validation.IsQualifiedName(key); len(errs) > 0 {
+			return fmt.Errorf("invalid annotation key %q: %s", key, strings.Join(errs, ", "))
+		}
+	}
+	return nil
+}
+
+// validateFlags checks the values of all command line flags which can
+// be checked without contacting the CSI driver or the API server. It
+// reports all problems at once instead of stopping at the first one.
+func validateFlags() error {
+	var errs []error
+	check := func(failed bool, format string, args ...interface{}) {
+		if failed {
+			errs = append(errs, fmt.Errorf(format, args...))
+		}
+	}
+	checkErr := func(prefix string, err error) {
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %v", prefix, err))
+		}
+	}
+
+	check(*resyncPeriod <= 0, "--resync-period must be positive, got %v", *resyncPeriod)
+	if *minK8sVersion != "" {
+		_, _, err := parseMajorMinor(*minK8sVersion)
+		checkErr("--min-k8s-version", err)
+	}
+	check(*keepaliveTime > 0 && *keepaliveTimeout <= 0, "--keepalive-timeout must be positive, got %v", *keepaliveTimeout)
+	check(*verifyNodeID && *nodeName == "", "--verify-node-id requires --node-name")
+	check(*registerCSINodeInfo && *nodeName == "", "--register-csinodeinfo requires --node-name")
+	check(*fieldManager == "", "--field-manager must not be empty")
+	check(*waitForCRD < 0, "--wait-for-crd must not be negative, got %v", *waitForCRD)
+	check(*startupJitter < 0, "--startup-jitter must not be negative, got %v", *startupJitter)
+	check(*objectTimeout < 0, "--object-timeout must not be negative, got %v", *objectTimeout)
+	check(*connectionRetryTimeout < 0, "--connection-retry-timeout must not be negative, got %v", *connectionRetryTimeout)
+	check(*probeTimeout < 0, "--probe-timeout must not be negative, got %v", *probeTimeout)
+	check(*healthStaleness < 0, "--health-staleness must not be negative, got %v", *healthStaleness)
+	check(*maxResyncBackoff < 0, "--max-resync-backoff must not be negative, got %v", *maxResyncBackoff)
+	_, err := retryBackoff(*retrySteps, *retryBaseDuration, *retryFactor)
+	checkErr("--retry-steps, --retry-base-duration, --retry-factor", err)
+	check(*shutdownTimeout <= 0, "--shutdown-timeout must be positive, got %v", *shutdownTimeout)
+	check(*csiTimeout <= 0, "--csi-timeout must be positive, got %v", *csiTimeout)
+	if *driverNameOverride != "" {
+		checkErr("--driver-name-override", validateDriverName(*driverNameOverride))
+	}
+	if *objectNameSuffix != "" {
+		// The suffix must be valid at the end of a DNS-1123 subdomain.
+		msgs := validation.IsDNS1123Subdomain("x" + *objectNameSuffix)
+		check(len(msgs) > 0, "--csidriver-resource-name-suffix: %q cannot be used at the end of a DNS-1123 subdomain: %s", *objectNameSuffix, strings.Join(msgs, ", "))
+	}
+	check(*printObject && (*selfTest || *dryRun), "--print-object cannot be used together with --self-test or --dry-run")
+	check(len(csiAddresses) > 1 && *driverNameOverride != "", "--driver-name-override cannot be used with more than one --csi-address")
+	for _, address := range csiAddresses {
+		errs = append(errs, validateCSIAddress(address))
+	}
+	_, err = ownerReference(*ownerRefAPIVersion, *ownerRefKind, *ownerRefName, *ownerRefUID)
+	errs = append(errs, err)
+	if *extraSpecJSON != "" {
+		unknown, err := applyExtraSpec(&k8scsi.CSIDriverSpec{}, *extraSpecJSON, *strictValidation)
+		checkErr("--extra-spec-json", err)
+		if len(unknown) > 0 {
+			glog.Warningf("--extra-spec-json: ignoring fields which are not supported by the %s CSIDriver API: %s", k8scsi.SchemeGroupVersion, strings.Join(unknown, ", "))
+		}
+	}
+	checkErr("--label", validateLabels(labels))
+	checkErr("--annotation", validateAnnotations(annotations))
+
+	// NewAggregate skips the nil entries.
+	return classify(validationFailure, utilerrors.NewAggregate(errs))
+}
@@ -0,0 +1,206 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+)
+
+func TestKeyValueFlag(t *testing.T) {
+	tests := []struct {
+		name        string
+		args        []string
+		expected    map[string]string
+		expectError bool
+	}{
+		{
+			name:     "single",
+			args:     []string{"team=storage"},
+			expected: map[string]string{"team": "storage"},
+		},
+		{
+			name: "multiple",
+			args: []string{"team=storage", "example.com/env=prod"},
+			expected: map[string]string{
+				"team":            "storage",
+				"example.com/env": "prod",
+			},
+		},
+		{
+			name:     "empty value",
+			args:     []string{"team="},
+			expected: map[string]string{"team": ""},
+		},
+		{
+			name:     "value with equal sign",
+			args:     []string{"query=a=b"},
+			expected: map[string]string{"query": "a=b"},
+		},
+		{
+			name:        "no equal sign",
+			args:        []string{"team"},
+			expectError: true,
+		},
+		{
+			name:        "empty key",
+			args:        []string{"=storage"},
+			expectError: true,
+		},
+		{
+			name:        "duplicate key",
+			args:        []string{"team=storage", "team=network"},
+			expectError: true,
+		},
+	}
+
+	for _, test := range tests {
+		kv := keyValueFlag{}
+		var err error
+		for _, arg := range test.args {
+			if err = kv.Set(arg); err != nil {
+				break
+			}
+		}
+		if test.expectError && err == nil {
+			t.Errorf("test %q: Expected error, got none", test.name)
+		}
+		if !test.expectError && err != nil {
+			t.Errorf("test %q: got error: %v", test.name, err)
+		}
+		if err == nil && !reflect.DeepEqual(map[string]string(kv), test.expected) {
+			t.Errorf("test %q: expected %v, got %v", test.name, test.expected, kv)
+		}
+	}
+}
+
+func TestStringListFlag(t *testing.T) {
+	var l stringListFlag
+	for _, arg := range []string{"/csi/a.sock", "/csi/b.sock"} {
+		if err := l.Set(arg); err != nil {
+			t.Fatalf("Set(%q) failed: %v", arg, err)
+		}
+	}
+	expected := stringListFlag{"/csi/a.sock", "/csi/b.sock"}
+	if !reflect.DeepEqual(l, expected) {
+		t.Errorf("expected %v, got %v", expected, l)
+	}
+	if l.String() != "/csi/a.sock,/csi/b.sock" {
+		t.Errorf("unexpected string %q", l.String())
+	}
+}
+
+func TestValidateLabels(t *testing.T) {
+	tests := []struct {
+		name        string
+		labels      map[string]string
+		expectError bool
+	}{
+		{
+			name:   "valid",
+			labels: map[string]string{"example.com/team": "storage"},
+		},
+		{
+			name:        "invalid key",
+			labels:      map[string]string{"team storage": "x"},
+			expectError: true,
+		},
+		{
+			name:        "invalid value",
+			labels:      map[string]string{"team": "storage/network"},
+			expectError: true,
+		},
+	}
+
+	for _, test := range tests {
+		err := validateLabels(test.labels)
+		if test.expectError && err == nil {
+			t.Errorf("test %q: Expected error, got none", test.name)
+		}
+		if !test.expectError && err != nil {
+			t.Errorf("test %q: got error: %v", test.name, err)
+		}
+	}
+}
+
+func TestValidateAnnotations(t *testing.T) {
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		expectError bool
+	}{
+		{
+			name:        "valid",
+			annotations: map[string]string{"example.com/managed-by": "storage team"},
+		},
+		{
+			name:        "invalid key",
+			annotations: map[string]string{"managed by": "storage"},
+			expectError: true,
+		},
+	}
+
+	for _, test := range tests {
+		err := validateAnnotations(test.annotations)
+		if test.expectError && err == nil {
+			t.Errorf("test %q: Expected error, got none", test.name)
+		}
+		if !test.expectError && err != nil {
+			t.Errorf("test %q: got error: %v", test.name, err)
+		}
+	}
+}
+
+func TestValidateFlags(t *testing.T) {
+	if err := validateFlags(); err != nil {
+		t.Fatalf("defaults: got error: %v", err)
+	}
+
+	defer func(period time.Duration) { *resyncPeriod = period }(*resyncPeriod)
+	defer func(manager string) { *fieldManager = manager }(*fieldManager)
+	defer func(l keyValueFlag) { labels = l }(labels)
+	defer func(suffix string) { *objectNameSuffix = suffix }(*objectNameSuffix)
+	defer func(timeout time.Duration) { *objectTimeout = timeout }(*objectTimeout)
+	defer func(backoff time.Duration) { *maxResyncBackoff = backoff }(*maxResyncBackoff)
+	*resyncPeriod = 0
+	*fieldManager = ""
+	labels = keyValueFlag{"app": "not valid"}
+	*objectNameSuffix = "_Cluster"
+	*objectTimeout = -time.Second
+	*maxResyncBackoff = -time.Second
+
+	err := validateFlags()
+	if errorClassOf(err) != validationFailure {
+		t.Errorf("expected validation error, got %v", err)
+	}
+	agg, ok := err.(*startupError).err.(utilerrors.Aggregate)
+	if !ok {
+		t.Fatalf("expected aggregated error, got %T", err.(*startupError).err)
+	}
+	if len(agg.Errors()) != 6 {
+		t.Errorf("expected 6 errors, got: %v", agg)
+	}
+	for _, flag := range []string{"--resync-period", "--field-manager", "--label", "--csidriver-resource-name-suffix", "--object-timeout", "--max-resync-backoff"} {
+		if !strings.Contains(err.Error(), flag) {
+			t.Errorf("expected error about %s, got: %v", flag, err)
+		}
+	}
+}
@@ -0,0 +1,152 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+
+	"github.com/kubernetes-csi/cluster-driver-registrar/pkg/connection"
+)
+
+// healthChecker reports the health of the connection to the CSI driver.
+// It is healthy if the driver was reachable within the staleness
+// window. Otherwise the driver gets probed again.
+type healthChecker struct {
+	csiConn   connection.CSIConnection
+	staleness time.Duration
+	timeout   time.Duration
+
+	mutex       sync.Mutex
+	lastSuccess time.Time
+}
+
+var (
+	_ http.Handler = &healthChecker{}
+)
+
+// succeeded records a successful call to the CSI driver.
+func (h *healthChecker) succeeded() {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.lastSuccess = time.Now()
+}
+
+func (h *healthChecker) healthy() bool {
+	h.mutex.Lock()
+	fresh := time.Since(h.lastSuccess) <= h.staleness
+	h.mutex.Unlock()
+	if fresh {
+		return true
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), h.timeout)
+	defer cancel()
+	ready, err := h.csiConn.Probe(ctx)
+	if err != nil {
+		glog.Warningf("Health check failed: %v", err)
+		return false
+	}
+	if !ready {
+		glog.Warning("Health check failed: CSI driver is not ready")
+		return false
+	}
+	h.succeeded()
+	return true
+}
+
+func (h *healthChecker) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if h.healthy() {
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("ok"))
+		return
+	}
+	w.WriteHeader(http.StatusServiceUnavailable)
+	w.Write([]byte("CSI driver is not reachable"))
+}
+
+// healthCheckers reports healthy only if all CSI drivers are healthy.
+type healthCheckers []*healthChecker
+
+var (
+	_ http.Handler = healthCheckers{}
+)
+
+func (h healthCheckers) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	for _, checker := range h {
+		if !checker.healthy() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte("CSI driver is not reachable"))
+			return
+		}
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("ok"))
+}
+
+// readinessChecker reports ready once the CSIDriver objects of all
+// expected drivers were registered successfully at least once. It never
+// becomes unready again.
+type readinessChecker struct {
+	mutex   sync.Mutex
+	pending map[string]bool
+}
+
+var (
+	_ http.Handler = &readinessChecker{}
+)
+
+// readiness is updated by verifyAndAddCSIDriverInfo.
+var readiness = &readinessChecker{}
+
+// expect adds a CSIDriver object which must be registered before the
+// registrar is ready.
+func (r *readinessChecker) expect(name string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.pending == nil {
+		r.pending = map[string]bool{}
+	}
+	r.pending[name] = true
+}
+
+// registered records that the CSIDriver object was registered.
+func (r *readinessChecker) registered(name string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	delete(r.pending, name)
+}
+
+func (r *readinessChecker) ready() bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.pending != nil && len(r.pending) == 0
+}
+
+func (r *readinessChecker) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if r.ready() {
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("ok"))
+		return
+	}
+	w.WriteHeader(http.StatusServiceUnavailable)
+	w.Write([]byte("CSI driver is not registered yet"))
+}
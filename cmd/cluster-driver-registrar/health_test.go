@@ -0,0 +1,63 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestReadinessChecker(t *testing.T) {
+	defer func(r *readinessChecker) { readiness = r }(readiness)
+	readiness = &readinessChecker{}
+
+	check := func(expected int) {
+		t.Helper()
+		recorder := httptest.NewRecorder()
+		readiness.ServeHTTP(recorder, httptest.NewRequest("GET", "/readyz", nil))
+		if recorder.Code != expected {
+			t.Errorf("expected status %d, got %d", expected, recorder.Code)
+		}
+	}
+
+	// Nothing to register yet.
+	check(http.StatusServiceUnavailable)
+
+	readiness.expect("a.example.com")
+	readiness.expect("b.example.com")
+	check(http.StatusServiceUnavailable)
+
+	registrar := newFakeRegistrar()
+	registrar.createErr = fmt.Errorf("mock error")
+	verifyAndAddCSIDriverInfo(context.Background(), registrar, makeCSIDriver("a.example.com", true, nil), false, false, false)
+	check(http.StatusServiceUnavailable)
+
+	registrar.createErr = nil
+	verifyAndAddCSIDriverInfo(context.Background(), registrar, makeCSIDriver("a.example.com", true, nil), false, false, false)
+	check(http.StatusServiceUnavailable)
+
+	verifyAndAddCSIDriverInfo(context.Background(), registrar, makeCSIDriver("b.example.com", true, nil), false, false, false)
+	check(http.StatusOK)
+
+	// Failures later on do not make it unready again.
+	registrar.getErr = fmt.Errorf("mock error")
+	verifyAndAddCSIDriverInfo(context.Background(), registrar, makeCSIDriver("b.example.com", true, nil), false, false, false)
+	check(http.StatusOK)
+}
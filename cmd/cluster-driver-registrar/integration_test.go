@@ -0,0 +1,144 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+
+	"github.com/kubernetes-csi/cluster-driver-registrar/pkg/fakedriver"
+)
+
+// TestRegisterFakeDriver runs the steps from main against a fake CSI
+// driver and a fake API server: discovery of the driver and creating
+// the CSIDriver object.
+func TestRegisterFakeDriver(t *testing.T) {
+	tests := []struct {
+		name                   string
+		capabilities           []csi.ControllerServiceCapability_RPC_Type
+		topology               bool
+		expectedAttachRequired bool
+	}{
+		{
+			name: "publish/unpublish",
+			capabilities: []csi.ControllerServiceCapability_RPC_Type{
+				csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME,
+				csi.ControllerServiceCapability_RPC_PUBLISH_UNPUBLISH_VOLUME,
+			},
+			expectedAttachRequired: true,
+		},
+		{
+			name: "no publish/unpublish",
+			capabilities: []csi.ControllerServiceCapability_RPC_Type{
+				csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME,
+			},
+			expectedAttachRequired: false,
+		},
+		{
+			name: "topology",
+			capabilities: []csi.ControllerServiceCapability_RPC_Type{
+				csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME,
+			},
+			topology:               true,
+			expectedAttachRequired: false,
+		},
+	}
+
+	dir, err := ioutil.TempDir("", "cluster-driver-registrar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for i, test := range tests {
+		socket := filepath.Join(dir, fmt.Sprintf("csi%d.sock", i))
+		driver := &fakedriver.Driver{
+			Name:                   "csi.example.com",
+			VendorVersion:          "1.0.0",
+			ControllerCapabilities: test.capabilities,
+			Topology:               test.topology,
+		}
+		if err := driver.Start(socket); err != nil {
+			t.Fatal(err)
+		}
+
+		d, err := discoverDriver(socket, &Config{}, nil, nil)
+		if err != nil {
+			t.Errorf("test %q: discovery failed: %v", test.name, err)
+			driver.Stop()
+			continue
+		}
+
+		if d.topology != test.topology {
+			t.Errorf("test %q: expected topology %t, got %t", test.name, test.topology, d.topology)
+		}
+
+		registrar := newFakeRegistrar()
+		if err := verifyAndAddCSIDriverInfo(context.Background(), registrar, d.csiDriver, false, false, false); err != nil {
+			t.Errorf("test %q: registration failed: %v", test.name, err)
+		}
+
+		expected := withCreatedBy(withAnnotations(makeCSIDriver("csi.example.com", test.expectedAttachRequired, nil),
+			map[string]string{driverVersionAnnotation: "1.0.0"}))
+		if obj := registrar.objects["csi.example.com"]; !reflect.DeepEqual(obj, expected) {
+			t.Errorf("test %q: expected object %+v, got %+v", test.name, expected, obj)
+		}
+
+		d.csiConn.Close()
+		driver.Stop()
+	}
+}
+
+// TestDiscoverEmptyDriverName checks that a driver without a name is
+// rejected right away instead of being retried.
+func TestDiscoverEmptyDriverName(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cluster-driver-registrar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for i, name := range []string{"", "  "} {
+		socket := filepath.Join(dir, fmt.Sprintf("csi%d.sock", i))
+		driver := &fakedriver.Driver{Name: name}
+		if err := driver.Start(socket); err != nil {
+			t.Fatal(err)
+		}
+
+		start := time.Now()
+		d, err := discoverDriver(socket, &Config{}, nil, nil)
+		if err == nil {
+			t.Errorf("name %q: Expected error, got none", name)
+			d.csiConn.Close()
+		} else if !strings.Contains(err.Error(), "empty name") {
+			t.Errorf("name %q: unexpected error: %v", name, err)
+		}
+		if elapsed := time.Since(start); elapsed >= initialRetryDelay {
+			t.Errorf("name %q: discovery was retried, took %v", name, elapsed)
+		}
+		driver.Stop()
+	}
+}
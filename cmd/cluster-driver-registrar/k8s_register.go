@@ -17,96 +17,845 @@ limitations under the License.
 package main
 
 import (
+	"context"
+	"fmt"
+	"math/rand"
+	"net/http"
 	"os"
-	"os/signal"
+	"reflect"
+	"sort"
+	"strings"
 	"time"
 
 	"github.com/golang/glog"
+	corev1 "k8s.io/api/core/v1"
 	crdclient "k8s.io/apiextensions-apiserver/pkg/client/clientset/clientset"
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
-	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/serializer"
+	"k8s.io/apimachinery/pkg/util/clock"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes/scheme"
 	"k8s.io/client-go/rest"
-	"k8s.io/client-go/util/retry"
 	k8scsi "k8s.io/csi-api/pkg/apis/csi/v1alpha1"
 	k8scsiclient "k8s.io/csi-api/pkg/client/clientset/versioned"
 	k8scsicrd "k8s.io/csi-api/pkg/crd"
+
+	"github.com/kubernetes-csi/cluster-driver-registrar/pkg/connection"
 )
 
-func kubernetesRegister(
-	config *rest.Config,
-	csiDriver *k8scsi.CSIDriver,
-) {
+// newRegistrar makes sure that the CSIDriver CRD is registered and
+// returns a Registrar for CSIDriver objects which uses fieldManager
+// as the name of the field manager.
+func newRegistrar(config *rest.Config, fieldManager string) (Registrar, error) {
 	// Get client info to CSIDriver
 	clientset, err := k8scsiclient.NewForConfig(config)
 	if err != nil {
-		glog.Error(err.Error())
-		os.Exit(1)
+		return nil, err
 	}
 
 	// Register CRD
 	glog.V(1).Info("Registering " + k8scsi.CsiDriverResourcePlural)
 	crdclient, err := crdclient.NewForConfig(config)
 	if err != nil {
-		glog.Error(err.Error())
-		os.Exit(1)
+		return nil, err
 	}
 	crdv1beta1client := crdclient.ApiextensionsV1beta1().CustomResourceDefinitions()
 	_, err = crdv1beta1client.Create(k8scsicrd.CSIDriverCRD())
 	if apierrors.IsAlreadyExists(err) {
 		glog.V(1).Info("CSIDriver CRD already had been registered")
 	} else if err != nil {
-		glog.Error(err.Error())
-		os.Exit(1)
+		return nil, err
 	}
 	glog.V(1).Info("CSIDriver CRD registered")
-	// Set up goroutine to cleanup (aka deregister) on termination.
-	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt)
-	go cleanup(c, clientset, csiDriver)
 
-	// Run forever
+	// The vendored client only supports the alpha API, which gets
+	// replaced by storage.k8s.io in later Kubernetes releases.
+	glog.Warningf("Using the deprecated %s CSIDriver API, support for it will be removed", k8scsi.SchemeGroupVersion)
+	apiVersionUsed.Inc(k8scsi.SchemeGroupVersion.Version)
+	return newAlphaRegistrar(clientset, fieldManager), nil
+}
+
+// newCoreRESTClient returns a client for the core/v1 API group. The
+// vendored client-go does not include the typed clientset for it.
+func newCoreRESTClient(config *rest.Config) (rest.Interface, error) {
+	coreConfig := *config
+	coreConfig.APIPath = "/api"
+	coreConfig.GroupVersion = &corev1.SchemeGroupVersion
+	coreConfig.NegotiatedSerializer = serializer.DirectCodecFactory{CodecFactory: scheme.Codecs}
+	return rest.RESTClientFor(&coreConfig)
+}
+
+// kubernetesRegister keeps the CSIDriver object registered until the
+// context is cancelled. All waiting between iterations is based on
+// clk. If nodeID is not nil, the node ID is verified in each
+// iteration. While registration keeps failing, the time between
+// iterations grows from the resync period up to maxBackoff.
+// With cleanupRenamed, the object follows name changes of the CSI
+// driver and the object with the old name gets deleted.
+func kubernetesRegister(
+	ctx context.Context,
+	clk clock.Clock,
+	registrar Registrar,
+	csiDriver *k8scsi.CSIDriver,
+	csiConn *driverConnection,
+	nodeID *nodeIDVerifier,
+	csiTimeout time.Duration,
+	resyncPeriod time.Duration,
+	maxBackoff time.Duration,
+	respectExisting bool,
+	allowRecreate bool,
+	exitOnDelete bool,
+	cleanupRenamed bool,
+) {
+	registered := false
+	backoff := &failureBackoff{base: resyncPeriod, max: maxBackoff}
+	watcher := &csiDriverWatcher{registrar: registrar, name: csiDriver.Name, clock: clk}
+	defer watcher.stop()
+	unwatched := &unwatchedDeleteRegistrar{Registrar: registrar, watcher: watcher}
 	for {
-		verifyAndAddCSIDriverInfo(clientset, csiDriver)
-		time.Sleep(sleepDuration)
+		start := clk.Now()
+		err := verifyAndAddCSIDriverInfo(ctx, unwatched, csiDriver, registered, respectExisting, allowRecreate)
+		if err == nil {
+			registered = true
+		}
+		if nodeID != nil && ctx.Err() == nil {
+			nodeID.verify(ctx, csiTimeout)
+		}
+		outcome := "success"
+		if err != nil {
+			outcome = "error"
+		}
+		reconcileDurationSeconds.Observe(clk.Since(start).Seconds(), outcome)
+		var delay time.Duration
+		if apierrors.IsForbidden(err) || apierrors.IsInvalid(err) {
+			// Retrying soon is pointless, someone has to fix
+			// the permissions or the object first.
+			delay = backoff.permanentFailure()
+		} else {
+			delay = backoff.next(err != nil)
+		}
+		if err != nil && ctx.Err() == nil {
+			glog.V(1).Infof("Registration failed %d times in a row, trying again in %v", backoff.failures, delay)
+		}
+		if !watcher.wait(ctx, delay) {
+			return
+		}
+		if exitOnDelete && watcher.deleted {
+			exitDeleted(csiDriver.Name)
+			return
+		}
+		if err := updateAttachRequired(ctx, csiConn, csiTimeout, csiDriver); err != nil && ctx.Err() == nil {
+			// The driver might have been restarted, try with a new
+			// connection. The next check happens after the next
+			// resync.
+			glog.V(1).Info("Reconnecting to CSI driver")
+			if err := csiConn.reconnect(ctx); err != nil {
+				glog.Warningf("Failed to reconnect to CSI driver: %v", err)
+			}
+		} else if err == nil {
+			updateDriverVersion(ctx, csiConn, csiTimeout, csiDriver)
+			if cleanupRenamed {
+				if driverName, stale := updateDriverName(ctx, csiConn, csiTimeout, csiDriver); stale != nil {
+					// Only an object created by the registrar
+					// gets deleted.
+					if err := verifyAndDeleteCSIDriverInfo(ctx, registrar, stale, true); err != nil {
+						glog.Warningf("Failed to delete CSIDriver object %s of the old driver name: %v", stale.Name, err)
+					}
+					registered = false
+					watcher.stop()
+					watcher.name = csiDriver.Name
+					if nodeID != nil {
+						nodeID.driverName = driverName
+					}
+				}
+			}
+		}
 	}
 }
 
-func cleanup(c <-chan os.Signal, clientSet *k8scsiclient.Clientset, csiDriver *k8scsi.CSIDriver) {
-	<-c
-	verifyAndDeleteCSIDriverInfo(clientSet, csiDriver)
-	os.Exit(1)
+// failureBackoff calculates the time until the next iteration of the
+// loop. It doubles with each consecutive failure, with some jitter, and
+// resets to the base after a success.
+type failureBackoff struct {
+	base     time.Duration
+	max      time.Duration
+	failures int
 }
 
-// Registers CSI driver by creating a CSIDriver object
+func (b *failureBackoff) next(failed bool) time.Duration {
+	if !failed {
+		b.failures = 0
+		return b.base
+	}
+	b.failures++
+	delay := b.base
+	for i := 1; i < b.failures && delay < b.max; i++ {
+		delay *= 2
+	}
+	if delay > b.max && b.max > b.base {
+		delay = b.max
+	}
+	return wait.Jitter(delay, 0.1)
+}
+
+// permanentFailure records a failure which will not go away by itself
+// and returns the maximum delay.
+func (b *failureBackoff) permanentFailure() time.Duration {
+	b.failures++
+	delay := b.max
+	if delay < b.base {
+		delay = b.base
+	}
+	return wait.Jitter(delay, 0.1)
+}
+
+// csiDriverWatcher watches the CSIDriver object for changes made by
+// someone else.
+type csiDriverWatcher struct {
+	registrar Registrar
+	name      string
+	watch     watch.Interface
+	clock     clock.Clock
+
+	// deleted is true if the last wait ended because the object
+	// was deleted.
+	deleted bool
+}
+
+// wait blocks until the resync period has passed or the CSIDriver
+// object was modified or deleted. Without a working watch it falls
+// back to waiting for the resync period. It returns false if the
+// context was cancelled.
+func (w *csiDriverWatcher) wait(ctx context.Context, resyncPeriod time.Duration) bool {
+	timer := w.clock.NewTimer(resyncPeriod)
+	defer timer.Stop()
+
+	w.deleted = false
+	for {
+		if w.watch == nil {
+			wi, err := w.registrar.Watch(w.name)
+			if err != nil {
+				glog.Warningf("Failed to watch CSIDriver object, waiting for resync: %v", err)
+			} else {
+				w.watch = wi
+			}
+		}
+		var events <-chan watch.Event
+		if w.watch != nil {
+			events = w.watch.ResultChan()
+		}
+
+		select {
+		case <-ctx.Done():
+			return false
+		case <-timer.C():
+			return true
+		case event, ok := <-events:
+			if !ok {
+				// The API server closed the watch, start a new one.
+				glog.V(4).Info("CSIDriver watch closed")
+				w.watch = nil
+				continue
+			}
+			switch event.Type {
+			case watch.Deleted:
+				glog.V(1).Infof("CSIDriver object %s was deleted", w.name)
+				w.deleted = true
+				return true
+			case watch.Modified:
+				glog.V(4).Infof("CSIDriver object %s was modified", w.name)
+				return true
+			case watch.Error:
+				glog.Warningf("CSIDriver watch failed: %v", apierrors.FromObject(event.Object))
+				w.watch.Stop()
+				w.watch = nil
+			}
+		}
+	}
+}
+
+// stop ends the watch, if there is one.
+func (w *csiDriverWatcher) stop() {
+	if w.watch != nil {
+		w.watch.Stop()
+		w.watch = nil
+	}
+}
+
+// unwatchedDeleteRegistrar stops the watch before the registrar itself
+// deletes the watched object, for example with --allow-recreate.
+// Otherwise the watch would report that deletion like one made by
+// someone else. The next wait starts a new watch.
+type unwatchedDeleteRegistrar struct {
+	Registrar
+	watcher *csiDriverWatcher
+}
+
+var (
+	_ Registrar = &unwatchedDeleteRegistrar{}
+)
+
+func (r *unwatchedDeleteRegistrar) Delete(name string) error {
+	if name == r.watcher.name {
+		r.watcher.stop()
+	}
+	return r.Registrar.Delete(name)
+}
+
+// updateAttachRequired asks the CSI driver again whether it requires
+// attach and updates the desired CSIDriver object accordingly. The
+// object is left unchanged when the driver cannot be reached and the
+// error is returned.
+func updateAttachRequired(ctx context.Context, csiConn connection.CSIConnection, csiTimeout time.Duration, csiDriver *k8scsi.CSIDriver) error {
+	ctx, cancel := context.WithTimeout(ctx, csiTimeout)
+	defer cancel()
+
+	attachRequired, err := csiConn.IsAttachRequired(ctx)
+	if err != nil {
+		glog.Warningf("Failed to check whether CSI driver requires attach: %v", err)
+		return err
+	}
+	if attachRequired != *csiDriver.Spec.AttachRequired {
+		glog.V(1).Infof("CSI driver changed AttachRequired from %t to %t", *csiDriver.Spec.AttachRequired, attachRequired)
+		csiDriver.Spec.AttachRequired = &attachRequired
+	}
+	return nil
+}
+
+// updateDriverVersion asks the CSI driver again for its version and
+// updates the annotation in the desired CSIDriver object, for example
+// after an upgrade of the driver.
+func updateDriverVersion(ctx context.Context, csiConn connection.CSIConnection, csiTimeout time.Duration, csiDriver *k8scsi.CSIDriver) {
+	ctx, cancel := context.WithTimeout(ctx, csiTimeout)
+	defer cancel()
+
+	driverVersion, err := csiConn.GetDriverVersion(ctx)
+	if err != nil {
+		glog.Warningf("Failed to get CSI driver version: %v", err)
+		return
+	}
+	if oldVersion := csiDriver.Annotations[driverVersionAnnotation]; driverVersion != oldVersion {
+		glog.V(1).Infof("CSI driver version changed from %q to %q", oldVersion, driverVersion)
+		csiDriver.Annotations = mergeMap(csiDriver.Annotations, map[string]string{driverVersionAnnotation: driverVersion})
+	}
+}
+
+// updateDriverName asks the CSI driver again for its name and renames
+// the desired CSIDriver object if it changed, for example after an
+// upgrade of the driver. It returns the new driver name and a copy of
+// the object with the old name, or nil if the name is unchanged or
+// cannot be used.
+func updateDriverName(ctx context.Context, csiConn connection.CSIConnection, csiTimeout time.Duration, csiDriver *k8scsi.CSIDriver) (string, *k8scsi.CSIDriver) {
+	ctx, cancel := context.WithTimeout(ctx, csiTimeout)
+	defer cancel()
+
+	name, err := csiConn.GetDriverName(ctx)
+	if err != nil {
+		glog.Warningf("Failed to get CSI driver name: %v", err)
+		return "", nil
+	}
+	objectName := csiDriverObjectName(name)
+	if objectName == csiDriver.Name {
+		return "", nil
+	}
+	if err := validateDriverName(objectName); err != nil {
+		glog.Warningf("Not renaming CSIDriver object %s: %v", csiDriver.Name, err)
+		return "", nil
+	}
+	glog.V(1).Infof("CSI driver name changed to %q, replacing the CSIDriver object %s with %s", name, csiDriver.Name, objectName)
+	stale := csiDriver.DeepCopy()
+	csiDriver.Name = objectName
+	return name, stale
+}
+
+// exit terminates the process. It is a variable so that tests can
+// replace it.
+var exit = os.Exit
+
+// fatalf logs the error, records it as termination message and exits
+// with code 1.
+func fatalf(format string, args ...interface{}) {
+	message := fmt.Sprintf(format, args...)
+	glog.Error(message)
+	writeTerminationMessage(*terminationLogPath, message)
+	glog.Flush()
+	exit(1)
+}
+
+// writeTerminationMessage writes the message to the termination log
+// file. Kubernetes creates that file for each container, so nothing is
+// written when it does not exist, for example when running outside of
+// a container.
+func writeTerminationMessage(path, message string) {
+	if path == "" {
+		return
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_TRUNC, 0)
+	if os.IsNotExist(err) {
+		return
+	}
+	if err == nil {
+		_, err = file.WriteString(message)
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	if err != nil {
+		glog.Warningf("Failed to write termination message to %s: %v", path, err)
+	}
+}
+
+// Exit code when the CSIDriver object was deleted and
+// --exit-on-csidriver-delete is set. It differs from the exit code of
+// other fatal errors.
+const exitCodeDeleted = 2
+
+// exitDeleted terminates the process because the CSIDriver object was
+// deleted by someone else.
+func exitDeleted(name string) {
+	msg := fmt.Sprintf("CSIDriver object %s was deleted, exiting because of --exit-on-csidriver-delete", name)
+	glog.Error(msg)
+	writeTerminationMessage(*terminationLogPath, msg)
+	glog.Flush()
+	exit(exitCodeDeleted)
+}
+
+// cancelOnSignal cancels the context when a termination signal is
+// received.
+func cancelOnSignal(c <-chan os.Signal, cancel context.CancelFunc) {
+	sig := <-c
+	glog.V(1).Infof("Received %s, shutting down", sig)
+	cancel()
+}
+
+// startupDelay sleeps for a random duration up to maxJitter, so that
+// many registrars which start at the same time do not all contact the
+// API server at once. It returns false if the context was cancelled
+// while waiting.
+func startupDelay(ctx context.Context, maxJitter time.Duration) bool {
+	if maxJitter <= 0 {
+		return true
+	}
+	delay := time.Duration(rand.Int63n(int64(maxJitter)))
+	glog.V(2).Infof("Waiting %v before registering", delay)
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+// cleanup deregisters the driver and stops the HTTP servers. It only
+// returns an error if deregistration failed or did not complete within
+// the timeout.
+func cleanup(remove func(ctx context.Context) error, servers []*http.Server, timeout time.Duration) error {
+	glog.V(1).Info("Removing CSIDriver object")
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	// The API calls themselves cannot be interrupted, so don't wait
+	// for them beyond the deadline.
+	done := make(chan error, 1)
+	go func() {
+		done <- remove(ctx)
+	}()
+	var err error
+	select {
+	case removeErr := <-done:
+		if removeErr != nil {
+			err = fmt.Errorf("Failed to remove CSIDriver object: %v", removeErr)
+		}
+	case <-ctx.Done():
+		glog.Warningf("Removing the CSIDriver object did not complete within %v, exiting anyway", timeout)
+		err = fmt.Errorf("Removing the CSIDriver object did not complete within %v", timeout)
+	}
+	shutdownHTTPServers(servers)
+	return err
+}
+
+// Registers CSI driver by creating a CSIDriver object. If the driver
+// was registered before, the object is expected to exist and
+// re-creating it is logged as a warning. An existing object which
+// appears to be managed by someone else is only updated if
+// respectExisting is false.
 func verifyAndAddCSIDriverInfo(
-	csiClientset *k8scsiclient.Clientset,
+	ctx context.Context,
+	registrar Registrar,
 	csiDriver *k8scsi.CSIDriver,
+	registered bool,
+	respectExisting bool,
+	allowRecreate bool,
 ) error {
-	retryErr := retry.RetryOnConflict(retry.DefaultRetry, func() error {
-		csidrivers := csiClientset.CsiV1alpha1().CSIDrivers()
+	retryErr := retryOnError(registerBackoff, isRetriable, func() error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
 
-		_, err := csidrivers.Create(csiDriver)
-		if err == nil {
+		existing, err := registrar.Get(csiDriver.Name)
+		if apierrors.IsNotFound(err) {
+			if registered {
+				glog.Warningf("CSIDriver object for driver %s was deleted, re-creating it", csiDriver.Name)
+			}
+			_, err := registrar.Create(withCreatedBy(csiDriver))
+			if err != nil {
+				logAPIError("create", err)
+				return err
+			}
 			glog.V(1).Infof("CSIDriver object created for driver %s", csiDriver.Name)
 			return nil
-		} else if apierrors.IsAlreadyExists(err) {
+		} else if err != nil {
+			logAPIError("get", err)
+			return err
+		}
+
+		// The object already exists, make sure that it still matches
+		// what the driver reports. Labels and annotations which
+		// someone else removed get added again, entries set by
+		// others are kept.
+		if missing := missingKeys(existing.Labels, csiDriver.Labels); len(missing) > 0 {
+			glog.V(1).Infof("Restoring labels %v of CSIDriver object %s", missing, csiDriver.Name)
+		}
+		if missing := missingKeys(existing.Annotations, csiDriver.Annotations); len(missing) > 0 {
+			glog.V(1).Infof("Restoring annotations %v of CSIDriver object %s", missing, csiDriver.Name)
+		}
+		updated := applyOwnedFields(existing, csiDriver)
+		if reflect.DeepEqual(existing, updated) {
 			glog.V(1).Info("CSIDriver CRD already had been registered")
 			return nil
 		}
-		glog.Errorf("Failed to create CSIDriver object: %v", err)
-		return err
+		if reason := externallyManaged(existing, csiDriver); reason != "" {
+			if respectExisting {
+				glog.Warningf("CSIDriver object %s differs from the desired state, but %s. Not modifying it because of --respect-existing.", csiDriver.Name, reason)
+				return nil
+			}
+			glog.Warningf("CSIDriver object %s differs from the desired state and %s. Updating it anyway, use --respect-existing to leave it alone.", csiDriver.Name, reason)
+		}
+		if glog.V(2) {
+			glog.Infof("Updating CSIDriver object %s: %s", csiDriver.Name, strings.Join(csiDriverDiff(existing, updated), ", "))
+		}
+		if _, err := registrar.Update(csiDriver); err != nil {
+			if apierrors.IsInvalid(err) {
+				return recreateCSIDriver(registrar, csiDriver, err, allowRecreate)
+			}
+			logAPIError("patch", err)
+			return err
+		}
+		glog.V(1).Infof("CSIDriver object updated for driver %s", csiDriver.Name)
+		return nil
 	})
+	if retryErr != nil {
+		addErrorsTotal.Inc(csiDriver.Name)
+	} else {
+		registeredGauge.Set(1, csiDriver.Name)
+		readiness.registered(csiDriver.Name)
+	}
 	return retryErr
 }
 
-// Deregister CSI Driver by deleting CSIDriver object
+// recreateCSIDriver handles an update which was rejected as invalid,
+// typically because an immutable field was changed. Such an object can
+// only be fixed by deleting and creating it again, which only happens
+// if allowRecreate is true. Otherwise updateErr is returned.
+func recreateCSIDriver(registrar Registrar, csiDriver *k8scsi.CSIDriver, updateErr error, allowRecreate bool) error {
+	if !allowRecreate {
+		glog.Errorf("CSIDriver object %s cannot be updated, probably because an immutable field differs. It must be deleted so that it gets created again, or use --allow-recreate. Error: %v", csiDriver.Name, updateErr)
+		return updateErr
+	}
+	glog.Warningf("CSIDriver object %s cannot be updated, deleting and creating it again because of --allow-recreate. Error: %v", csiDriver.Name, updateErr)
+	if err := registrar.Delete(csiDriver.Name); err != nil && !apierrors.IsNotFound(err) {
+		logAPIError("delete", err)
+		return err
+	}
+	if _, err := registrar.Create(withCreatedBy(csiDriver)); err != nil {
+		logAPIError("create", err)
+		return err
+	}
+	glog.V(1).Infof("CSIDriver object re-created for driver %s", csiDriver.Name)
+	return nil
+}
+
+// registerBackoff is used for retrying API calls for the CSIDriver
+// object. By default it gives up after about three seconds, the next
+// attempt then happens in the next iteration of the loop. The
+// --retry-* flags replace it with retryBackoff.
+var registerBackoff = wait.Backoff{
+	Steps:    5,
+	Duration: 100 * time.Millisecond,
+	Factor:   2.0,
+	Jitter:   0.1,
+}
+
+// retryBackoff returns registerBackoff with the given number of steps,
+// initial duration and factor.
+func retryBackoff(steps int, duration time.Duration, factor float64) (wait.Backoff, error) {
+	if steps < 1 {
+		return wait.Backoff{}, fmt.Errorf("number of steps must be at least 1, got %d", steps)
+	}
+	if duration <= 0 {
+		return wait.Backoff{}, fmt.Errorf("base duration must be positive, got %v", duration)
+	}
+	if factor < 1 {
+		return wait.Backoff{}, fmt.Errorf("factor must be at least 1, got %v", factor)
+	}
+	backoff := registerBackoff
+	backoff.Steps = steps
+	backoff.Duration = duration
+	backoff.Factor = factor
+	return backoff, nil
+}
+
+// isRetriable returns true for conflicts and for errors which indicate
+// that the API server is temporarily unable to handle the request.
+func isRetriable(err error) bool {
+	return apierrors.IsConflict(err) ||
+		apierrors.IsServerTimeout(err) ||
+		apierrors.IsTooManyRequests(err) ||
+		apierrors.IsInternalError(err)
+}
+
+// retryOnError is like retry.RetryOnConflict, except that it retries
+// all errors for which retriable returns true.
+func retryOnError(backoff wait.Backoff, retriable func(error) bool, fn func() error) error {
+	var lastErr error
+	err := wait.ExponentialBackoff(backoff, func() (bool, error) {
+		err := fn()
+		switch {
+		case err == nil:
+			return true, nil
+		case retriable(err):
+			glog.V(4).Infof("Retrying after error: %v", err)
+			lastErr = err
+			return false, nil
+		default:
+			return false, err
+		}
+	})
+	if err == wait.ErrWaitTimeout {
+		err = lastErr
+	}
+	return err
+}
+
+// retryUntilDeadline is like retryOnError, except that it continues
+// after the steps of the backoff are used up, with the last delay,
+// until the next attempt would start after the deadline of the
+// context. It then returns the last error, so that the caller can
+// report why it gave up.
+func retryUntilDeadline(ctx context.Context, backoff wait.Backoff, retriable func(error) bool, fn func() error) error {
+	deadline, _ := ctx.Deadline()
+	delay := backoff.Duration
+	for step := 1; ; step++ {
+		err := fn()
+		if err == nil || !retriable(err) {
+			return err
+		}
+		sleep := delay
+		if backoff.Jitter > 0 {
+			sleep = wait.Jitter(delay, backoff.Jitter)
+		}
+		if time.Now().Add(sleep).After(deadline) {
+			glog.Errorf("Giving up after %d attempts because of the deadline: %v", step, err)
+			return err
+		}
+		glog.V(4).Infof("Retrying after error: %v", err)
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(sleep):
+		}
+		if step < backoff.Steps {
+			delay = time.Duration(float64(delay) * backoff.Factor)
+		}
+	}
+}
+
+// logAPIError logs a failed API call for the CSIDriver object. A
+// missing permission is explained instead of only logging the raw
+// error, because retrying will not help until the RBAC rules are fixed.
+func logAPIError(verb string, err error) {
+	if apierrors.IsForbidden(err) {
+		glog.Errorf("Not allowed to %s CSIDriver objects. The service account of the registrar needs the %q verb for the %q resource in the %q API group, see deploy/kubernetes/rbac.yaml. Error: %v",
+			verb, verb, k8scsi.CsiDriverResourcePlural, k8scsi.GroupName, err)
+		return
+	}
+	glog.Errorf("Failed to %s CSIDriver object: %v", verb, err)
+}
+
+// Label which tools like Helm set on objects that they manage.
+const managedByLabel = "app.kubernetes.io/managed-by"
+
+// externallyManaged describes why the existing object seems to be
+// managed by someone else. It returns an empty string if the object
+// looks like it was created by the registrar.
+func externallyManaged(existing, desired *k8scsi.CSIDriver) string {
+	if _, ok := existing.Annotations[versionAnnotation]; !ok {
+		return "it was not created by the cluster-driver-registrar"
+	}
+	return managedByOthers(existing, desired)
+}
+
+// notCreatedByRegistrar is like externallyManaged, except that it
+// relies on createdByAnnotation. versionAnnotation is not enough to
+// decide about deletion because updating an existing object adds it.
+func notCreatedByRegistrar(existing, desired *k8scsi.CSIDriver) string {
+	if _, ok := existing.Annotations[createdByAnnotation]; !ok {
+		return "it was not created by the cluster-driver-registrar"
+	}
+	return managedByOthers(existing, desired)
+}
+
+// managedByOthers describes why the existing object seems to be owned
+// or managed by someone else, regardless of who created it.
+func managedByOthers(existing, desired *k8scsi.CSIDriver) string {
+	if len(existing.OwnerReferences) > 0 && !reflect.DeepEqual(existing.OwnerReferences, desired.OwnerReferences) {
+		owner := existing.OwnerReferences[0]
+		return fmt.Sprintf("it is owned by %s %s", owner.Kind, owner.Name)
+	}
+	if managedBy, ok := existing.Labels[managedByLabel]; ok && managedBy != desired.Labels[managedByLabel] {
+		return fmt.Sprintf("it is managed by %s", managedBy)
+	}
+	return ""
+}
+
+// withCreatedBy returns a copy of the desired object for creating it,
+// with createdByAnnotation. The annotation is not part of the desired
+// object itself, so updates never add it to an existing object.
+func withCreatedBy(csiDriver *k8scsi.CSIDriver) *k8scsi.CSIDriver {
+	obj := csiDriver.DeepCopy()
+	obj.Annotations = mergeMap(obj.Annotations, map[string]string{createdByAnnotation: "true"})
+	return obj
+}
+
+// mergeMap returns a new map with all entries from base and src, where
+// entries from src take precedence. Neither map is modified, so maps
+// may be shared between objects. The result is nil if both are empty.
+func mergeMap(base, src map[string]string) map[string]string {
+	if len(base) == 0 && len(src) == 0 {
+		return nil
+	}
+	merged := make(map[string]string, len(base)+len(src))
+	for key, value := range base {
+		merged[key] = value
+	}
+	for key, value := range src {
+		merged[key] = value
+	}
+	return merged
+}
+
+// missingKeys returns the sorted keys from desired which have a
+// different value or are not set at all in current.
+func missingKeys(current, desired map[string]string) []string {
+	var keys []string
+	for key, value := range desired {
+		if v, ok := current[key]; !ok || v != value {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// csiDriverDiff describes how the fields owned by the registrar differ
+// between two CSIDriver objects, one entry per changed field.
+func csiDriverDiff(old, new *k8scsi.CSIDriver) []string {
+	var diff []string
+	change := func(field, oldValue, newValue string) {
+		if oldValue != newValue {
+			diff = append(diff, fmt.Sprintf("%s: %s -> %s", field, oldValue, newValue))
+		}
+	}
+	change("spec.attachRequired", boolPtrString(old.Spec.AttachRequired), boolPtrString(new.Spec.AttachRequired))
+	change("spec.podInfoOnMountVersion", stringPtrString(old.Spec.PodInfoOnMountVersion), stringPtrString(new.Spec.PodInfoOnMountVersion))
+	for _, m := range []struct {
+		field    string
+		old, new map[string]string
+	}{
+		{"labels", old.Labels, new.Labels},
+		{"annotations", old.Annotations, new.Annotations},
+	} {
+		keys := sets.NewString()
+		for key := range m.old {
+			keys.Insert(key)
+		}
+		for key := range m.new {
+			keys.Insert(key)
+		}
+		for _, key := range keys.List() {
+			change(fmt.Sprintf("%s[%s]", m.field, key), mapValueString(m.old, key), mapValueString(m.new, key))
+		}
+	}
+	return diff
+}
+
+func boolPtrString(b *bool) string {
+	if b == nil {
+		return "<unset>"
+	}
+	return fmt.Sprintf("%t", *b)
+}
+
+func stringPtrString(s *string) string {
+	if s == nil {
+		return "<unset>"
+	}
+	return fmt.Sprintf("%q", *s)
+}
+
+func mapValueString(m map[string]string, key string) string {
+	value, ok := m[key]
+	if !ok {
+		return "<unset>"
+	}
+	return fmt.Sprintf("%q", value)
+}
+
+// Deregister CSI Driver by deleting CSIDriver object. Retrying stops
+// when the context is done. With deleteOnlyOwned, an object which
+// appears to be managed by someone else is left alone.
 func verifyAndDeleteCSIDriverInfo(
-	csiClientset *k8scsiclient.Clientset,
+	ctx context.Context,
+	registrar Registrar,
 	csiDriver *k8scsi.CSIDriver,
+	deleteOnlyOwned bool,
 ) error {
-	retryErr := retry.RetryOnConflict(retry.DefaultRetry, func() error {
-		csidrivers := csiClientset.CsiV1alpha1().CSIDrivers()
-		err := csidrivers.Delete(csiDriver.Name, &metav1.DeleteOptions{})
+	retry := func(fn func() error) error {
+		return retryOnError(registerBackoff, isRetriable, fn)
+	}
+	if _, ok := ctx.Deadline(); ok {
+		// During shutdown, keep trying for as long as the
+		// deadline allows instead of giving up after the usual
+		// number of steps.
+		retry = func(fn func() error) error {
+			return retryUntilDeadline(ctx, registerBackoff, isRetriable, fn)
+		}
+	}
+	retryErr := retry(func() error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		if deleteOnlyOwned {
+			existing, err := registrar.Get(csiDriver.Name)
+			if apierrors.IsNotFound(err) {
+				glog.V(1).Info("No need to clean up CSIDriver since it does not exist")
+				return nil
+			} else if err != nil {
+				logAPIError("get", err)
+				return err
+			}
+			if reason := notCreatedByRegistrar(existing, csiDriver); reason != "" {
+				glog.Warningf("Not deleting CSIDriver object %s because %s and --delete-only-owned is set", csiDriver.Name, reason)
+				return nil
+			}
+		}
+
+		err := registrar.Delete(csiDriver.Name)
 		if err == nil {
 			glog.V(1).Infof("CSIDriver object deleted for driver %s", csiDriver.Name)
 			return nil
@@ -114,8 +863,13 @@ func verifyAndDeleteCSIDriverInfo(
 			glog.V(1).Info("No need to clean up CSIDriver since it does not exist")
 			return nil
 		}
-		glog.Errorf("Failed to delete CSIDriver object: %v", err)
+		logAPIError("delete", err)
 		return err
 	})
+	if retryErr != nil {
+		removeErrorsTotal.Inc(csiDriver.Name)
+	} else {
+		registeredGauge.Set(0, csiDriver.Name)
+	}
 	return retryErr
 }
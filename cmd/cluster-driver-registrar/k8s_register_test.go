@@ -0,0 +1,1234 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/clock"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/apimachinery/pkg/watch"
+	k8scsi "k8s.io/csi-api/pkg/apis/csi/v1alpha1"
+)
+
+func TestCancelOnSignal(t *testing.T) {
+	for _, sig := range terminationSignals {
+		c := make(chan os.Signal, 1)
+		ctx, cancel := context.WithCancel(context.Background())
+
+		c <- sig
+		cancelOnSignal(c, cancel)
+		if ctx.Err() == nil {
+			t.Errorf("%s: context was not cancelled", sig)
+		}
+	}
+}
+
+func TestRetryBackoff(t *testing.T) {
+	tests := []struct {
+		name        string
+		steps       int
+		duration    time.Duration
+		factor      float64
+		expectError bool
+	}{
+		{
+			name:     "defaults",
+			steps:    registerBackoff.Steps,
+			duration: registerBackoff.Duration,
+			factor:   registerBackoff.Factor,
+		},
+		{
+			name:     "single attempt",
+			steps:    1,
+			duration: time.Second,
+			factor:   1,
+		},
+		{
+			name:        "no steps",
+			steps:       0,
+			duration:    time.Second,
+			factor:      2,
+			expectError: true,
+		},
+		{
+			name:        "zero duration",
+			steps:       5,
+			factor:      2,
+			expectError: true,
+		},
+		{
+			name:        "shrinking",
+			steps:       5,
+			duration:    time.Second,
+			factor:      0.5,
+			expectError: true,
+		},
+	}
+
+	for _, test := range tests {
+		backoff, err := retryBackoff(test.steps, test.duration, test.factor)
+		if test.expectError {
+			if err == nil {
+				t.Errorf("test %q: Expected error, got none", test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("test %q: got error: %v", test.name, err)
+			continue
+		}
+		expected := wait.Backoff{
+			Steps:    test.steps,
+			Duration: test.duration,
+			Factor:   test.factor,
+			Jitter:   registerBackoff.Jitter,
+		}
+		if backoff != expected {
+			t.Errorf("test %q: expected %+v, got %+v", test.name, expected, backoff)
+		}
+	}
+}
+
+func TestStartupDelay(t *testing.T) {
+	if !startupDelay(context.Background(), 0) {
+		t.Error("no delay: expected true")
+	}
+
+	start := time.Now()
+	if !startupDelay(context.Background(), 10*time.Millisecond) {
+		t.Error("short delay: expected true")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("short delay: took %v", elapsed)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	start = time.Now()
+	if startupDelay(ctx, time.Hour) {
+		t.Error("cancelled: expected false")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("cancelled: took %v", elapsed)
+	}
+}
+
+func TestCleanup(t *testing.T) {
+	tests := []struct {
+		name        string
+		removeError error
+		removeHangs bool
+		expectError bool
+	}{
+		{
+			name: "success",
+		},
+		{
+			name:        "remove error",
+			removeError: fmt.Errorf("mock error"),
+			expectError: true,
+		},
+		{
+			name:        "timeout",
+			removeHangs: true,
+			expectError: true,
+		},
+	}
+
+	for _, test := range tests {
+		removed := make(chan bool, 1)
+		stop := make(chan struct{})
+		remove := func(ctx context.Context) error {
+			removed <- true
+			if test.removeHangs {
+				<-stop
+			}
+			return test.removeError
+		}
+
+		err := cleanup(remove, nil, 100*time.Millisecond)
+		close(stop)
+		if len(removed) == 0 {
+			t.Errorf("test %q: remove() was not called", test.name)
+		}
+		if test.expectError && err == nil {
+			t.Errorf("test %q: Expected error, got none", test.name)
+		}
+		if !test.expectError && err != nil {
+			t.Errorf("test %q: got error: %v", test.name, err)
+		}
+	}
+}
+
+func TestFatalf(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cluster-driver-registrar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "termination-log")
+	if err := ioutil.WriteFile(path, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	defer func(path string) { *terminationLogPath = path }(*terminationLogPath)
+	*terminationLogPath = path
+	defer func() { exit = os.Exit }()
+	code := -1
+	exit = func(c int) {
+		code = c
+	}
+
+	fatalf("mock error %d", 42)
+	if code != 1 {
+		t.Errorf("expected exit code 1, got %d", code)
+	}
+	message, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(message) != "mock error 42" {
+		t.Errorf("expected termination message %q, got %q", "mock error 42", string(message))
+	}
+}
+
+func TestWriteTerminationMessageMissingFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cluster-driver-registrar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "termination-log")
+
+	writeTerminationMessage(path, "mock error")
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("expected no termination log to be created, got: %v", err)
+	}
+}
+
+func TestKubernetesRegister(t *testing.T) {
+	registrar := newFakeRegistrar()
+	csiDriver := makeCSIDriver("csi.example.com", true, nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	// The context is already cancelled, so kubernetesRegister must
+	// return without touching the object.
+	kubernetesRegister(ctx, clock.RealClock{}, registrar, csiDriver, nil, nil, time.Second, time.Hour, time.Hour, false, false, false, false)
+	if registrar.creates != 0 {
+		t.Errorf("expected no create with cancelled context, got %d", registrar.creates)
+	}
+}
+
+func TestKubernetesRegisterExitOnDelete(t *testing.T) {
+	defer func(path string) { *terminationLogPath = path }(*terminationLogPath)
+	*terminationLogPath = ""
+	defer func() { exit = os.Exit }()
+
+	for _, exitOnDelete := range []bool{false, true} {
+		registrar := newFakeRegistrar()
+		registrar.watcher.Delete(makeCSIDriver("csi.example.com", true, nil))
+		csiDriver := makeCSIDriver("csi.example.com", true, nil)
+		ctx, cancel := context.WithCancel(context.Background())
+
+		code := -1
+		exit = func(c int) {
+			code = c
+			cancel()
+		}
+		csiConn := newDriverConnection(&fakeCSIConnection{attachRequired: true}, "csi.example.com", nil)
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			kubernetesRegister(ctx, clock.RealClock{}, registrar, csiDriver, csiConn, nil, time.Second, time.Hour, time.Hour, false, false, exitOnDelete, false)
+		}()
+		if !exitOnDelete {
+			// The deletion triggers another iteration, then the
+			// loop waits for the resync period.
+			time.Sleep(100 * time.Millisecond)
+			cancel()
+		}
+		<-done
+
+		expectedCode := -1
+		if exitOnDelete {
+			expectedCode = exitCodeDeleted
+		}
+		if code != expectedCode {
+			t.Errorf("exit on delete %t: expected exit code %d, got %d", exitOnDelete, expectedCode, code)
+		}
+		cancel()
+	}
+}
+
+// TestKubernetesRegisterRecreateNoExit checks that deleting the object
+// for --allow-recreate does not count as a deletion for
+// --exit-on-csidriver-delete.
+func TestKubernetesRegisterRecreateNoExit(t *testing.T) {
+	defer func(path string) { *terminationLogPath = path }(*terminationLogPath)
+	*terminationLogPath = ""
+	defer func() { exit = os.Exit }()
+
+	registrar := newFakeRegistrar(makeCSIDriver("csi.example.com", false, nil))
+	registrar.updateErr = errImmutable
+	registrar.watchDeletes = true
+	// The modification triggers a second iteration. By then the
+	// driver no longer requires attach, so the object gets
+	// re-created again, this time while the watch is active.
+	registrar.watcher.Modify(makeCSIDriver("csi.example.com", false, nil))
+	csiDriver := makeCSIDriver("csi.example.com", true, nil)
+	ctx, cancel := context.WithCancel(context.Background())
+
+	code := -1
+	exit = func(c int) {
+		code = c
+		cancel()
+	}
+	csiConn := newDriverConnection(&fakeCSIConnection{attachRequired: false}, "csi.example.com", nil)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		kubernetesRegister(ctx, clock.RealClock{}, registrar, csiDriver, csiConn, nil, time.Second, time.Hour, time.Hour, false, true, true, false)
+	}()
+	time.Sleep(100 * time.Millisecond)
+	cancel()
+	<-done
+
+	if registrar.deletes != 2 || registrar.creates != 2 {
+		t.Errorf("expected 2 deletes and 2 creates, got %d and %d", registrar.deletes, registrar.creates)
+	}
+	if code != -1 {
+		t.Errorf("expected no exit, got exit code %d", code)
+	}
+}
+
+// attemptCountingRegistrar counts all create calls, including the
+// failed ones.
+type attemptCountingRegistrar struct {
+	*fakeRegistrar
+	attempts int
+}
+
+func (r *attemptCountingRegistrar) Create(csiDriver *k8scsi.CSIDriver) (*k8scsi.CSIDriver, error) {
+	r.attempts++
+	return r.fakeRegistrar.Create(csiDriver)
+}
+
+func TestKubernetesRegisterBackoff(t *testing.T) {
+	registrar := &attemptCountingRegistrar{fakeRegistrar: newFakeRegistrar()}
+	registrar.createErr = fmt.Errorf("mock error")
+	registrar.watchErr = fmt.Errorf("mock error")
+	csiDriver := makeCSIDriver("csi.example.com", true, nil)
+	csiConn := newDriverConnection(&fakeCSIConnection{attachRequired: true}, "csi.example.com", nil)
+	fakeClock := clock.NewFakeClock(time.Now())
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	resyncPeriod := time.Minute
+	maxBackoff := 4 * time.Minute
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		kubernetesRegister(ctx, fakeClock, registrar, csiDriver, csiConn, nil, time.Second, resyncPeriod, maxBackoff, false, false, false, false)
+	}()
+
+	// Each failed iteration waits twice as long as the previous one,
+	// up to maxBackoff, with at most 10% jitter.
+	for i, delay := range []time.Duration{time.Minute, 2 * time.Minute, 4 * time.Minute, 4 * time.Minute} {
+		waitForWaiters(t, fakeClock)
+		if registrar.attempts != i+1 {
+			t.Fatalf("iteration #%d: expected %d attempts, got %d", i, i+1, registrar.attempts)
+		}
+		// Shortly before the earliest end of the delay, the loop
+		// must still be waiting.
+		fakeClock.Step(delay - time.Second)
+		if !fakeClock.HasWaiters() {
+			t.Fatalf("iteration #%d: loop stopped waiting before %v", i, delay)
+		}
+		fakeClock.Step(delay/10 + 2*time.Second)
+	}
+
+	// After a success, the loop falls back to the resync period.
+	waitForWaiters(t, fakeClock)
+	registrar.createErr = nil
+	fakeClock.Step(maxBackoff + maxBackoff/10)
+	waitForWaiters(t, fakeClock)
+	if registrar.attempts != 6 || registrar.creates != 1 {
+		t.Fatalf("expected 6 attempts and 1 create, got %d and %d", registrar.attempts, registrar.creates)
+	}
+	// The removed object gets recreated after the resync period.
+	delete(registrar.objects, csiDriver.Name)
+	fakeClock.Step(resyncPeriod)
+	waitForWaiters(t, fakeClock)
+	if registrar.attempts != 7 {
+		t.Errorf("expected 7 attempts after resync, got %d", registrar.attempts)
+	}
+
+	cancel()
+	<-done
+}
+
+// waitForWaiters blocks until someone waits for the fake clock.
+func waitForWaiters(t *testing.T, fakeClock *clock.FakeClock) {
+	for i := 0; i < 1000; i++ {
+		if fakeClock.HasWaiters() {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatal("timed out waiting for the loop to wait")
+}
+
+func TestKubernetesRegisterCleanupRenamed(t *testing.T) {
+	for _, cleanupRenamed := range []bool{false, true} {
+		registrar := newFakeRegistrar()
+		// The deletion triggers a second iteration.
+		registrar.watcher.Delete(makeCSIDriver("csi.example.com", true, nil))
+		csiDriver := withAnnotations(makeCSIDriver("csi.example.com", true, nil), map[string]string{versionAnnotation: "v1"})
+		csiConn := newDriverConnection(&fakeCSIConnection{name: "new.example.com", attachRequired: true}, "csi.example.com", nil)
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			kubernetesRegister(ctx, clock.RealClock{}, registrar, csiDriver, csiConn, nil, time.Second, time.Hour, time.Hour, false, false, false, cleanupRenamed)
+		}()
+		time.Sleep(100 * time.Millisecond)
+		cancel()
+		<-done
+
+		expectedName := "csi.example.com"
+		if cleanupRenamed {
+			expectedName = "new.example.com"
+		}
+		if csiDriver.Name != expectedName {
+			t.Errorf("cleanup renamed %t: expected name %q, got %q", cleanupRenamed, expectedName, csiDriver.Name)
+		}
+		var names []string
+		for name := range registrar.objects {
+			names = append(names, name)
+		}
+		if !reflect.DeepEqual(names, []string{expectedName}) {
+			t.Errorf("cleanup renamed %t: expected only object %s, got %v", cleanupRenamed, expectedName, names)
+		}
+	}
+}
+
+func TestUpdateDriverName(t *testing.T) {
+	tests := []struct {
+		name         string
+		conn         *fakeCSIConnection
+		expectStale  bool
+		expectedName string
+	}{
+		{
+			name:         "unchanged",
+			conn:         &fakeCSIConnection{name: "csi.example.com"},
+			expectedName: "csi.example.com",
+		},
+		{
+			name:         "renamed",
+			conn:         &fakeCSIConnection{name: "new.example.com"},
+			expectStale:  true,
+			expectedName: "new.example.com",
+		},
+		{
+			name:         "invalid name",
+			conn:         &fakeCSIConnection{name: "New_Driver"},
+			expectedName: "csi.example.com",
+		},
+		{
+			name:         "failure",
+			conn:         &fakeCSIConnection{err: fmt.Errorf("mock error")},
+			expectedName: "csi.example.com",
+		},
+	}
+
+	for _, test := range tests {
+		csiDriver := makeCSIDriver("csi.example.com", true, nil)
+		_, stale := updateDriverName(context.Background(), test.conn, time.Second, csiDriver)
+		if test.expectStale {
+			if stale == nil || stale.Name != "csi.example.com" {
+				t.Errorf("test %q: expected stale object csi.example.com, got %+v", test.name, stale)
+			}
+		} else if stale != nil {
+			t.Errorf("test %q: expected no stale object, got %+v", test.name, stale)
+		}
+		if csiDriver.Name != test.expectedName {
+			t.Errorf("test %q: expected name %q, got %q", test.name, test.expectedName, csiDriver.Name)
+		}
+	}
+}
+
+func TestUpdateDriverNameSuffix(t *testing.T) {
+	defer func(suffix string) { *objectNameSuffix = suffix }(*objectNameSuffix)
+	*objectNameSuffix = ".cluster-a"
+
+	csiDriver := makeCSIDriver("csi.example.com.cluster-a", true, nil)
+	conn := &fakeCSIConnection{name: "csi.example.com"}
+	if _, stale := updateDriverName(context.Background(), conn, time.Second, csiDriver); stale != nil {
+		t.Errorf("expected no stale object, got %+v", stale)
+	}
+
+	conn.name = "new.example.com"
+	driverName, stale := updateDriverName(context.Background(), conn, time.Second, csiDriver)
+	if stale == nil || stale.Name != "csi.example.com.cluster-a" {
+		t.Errorf("expected stale object csi.example.com.cluster-a, got %+v", stale)
+	}
+	if driverName != "new.example.com" {
+		t.Errorf("expected driver name new.example.com, got %q", driverName)
+	}
+	if csiDriver.Name != "new.example.com.cluster-a" {
+		t.Errorf("expected name new.example.com.cluster-a, got %q", csiDriver.Name)
+	}
+}
+
+func makeCSIDriver(name string, attachRequired bool, labels map[string]string) *k8scsi.CSIDriver {
+	podInfoOnMountVersion := ""
+	return &k8scsi.CSIDriver{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   name,
+			Labels: labels,
+		},
+		Spec: k8scsi.CSIDriverSpec{
+			AttachRequired:        &attachRequired,
+			PodInfoOnMountVersion: &podInfoOnMountVersion,
+		},
+	}
+}
+
+// makeManagedCSIDriver returns a CSIDriver object as created by the
+// registrar, optionally with an owner.
+func makeManagedCSIDriver(name string, attachRequired bool, owner *metav1.OwnerReference) *k8scsi.CSIDriver {
+	csiDriver := makeCSIDriver(name, attachRequired, nil)
+	csiDriver.Annotations = map[string]string{versionAnnotation: "test"}
+	if owner != nil {
+		csiDriver.OwnerReferences = []metav1.OwnerReference{*owner}
+	}
+	return csiDriver
+}
+
+// withPodInfoOnMountVersion sets the pod info version in the spec.
+func withPodInfoOnMountVersion(csiDriver *k8scsi.CSIDriver, version string) *k8scsi.CSIDriver {
+	csiDriver.Spec.PodInfoOnMountVersion = &version
+	return csiDriver
+}
+
+// withAnnotations adds annotations to the object.
+func withAnnotations(csiDriver *k8scsi.CSIDriver, annotations map[string]string) *k8scsi.CSIDriver {
+	csiDriver.Annotations = mergeMap(csiDriver.Annotations, annotations)
+	return csiDriver
+}
+
+func TestMissingKeys(t *testing.T) {
+	tests := []struct {
+		name     string
+		current  map[string]string
+		desired  map[string]string
+		expected []string
+	}{
+		{
+			name: "empty",
+		},
+		{
+			name:    "all present",
+			current: map[string]string{"a": "1", "other": "x"},
+			desired: map[string]string{"a": "1"},
+		},
+		{
+			name:     "removed and changed",
+			current:  map[string]string{"b": "other", "other": "x"},
+			desired:  map[string]string{"a": "1", "b": "2", "c": "3"},
+			expected: []string{"a", "b", "c"},
+		},
+	}
+
+	for _, test := range tests {
+		keys := missingKeys(test.current, test.desired)
+		if !reflect.DeepEqual(keys, test.expected) {
+			t.Errorf("test %q: expected %v, got %v", test.name, test.expected, keys)
+		}
+	}
+}
+
+func TestCSIDriverDiff(t *testing.T) {
+	tests := []struct {
+		name     string
+		old      *k8scsi.CSIDriver
+		new      *k8scsi.CSIDriver
+		expected []string
+	}{
+		{
+			name: "equal",
+			old:  makeCSIDriver("csi.example.com", true, map[string]string{"team": "storage"}),
+			new:  makeCSIDriver("csi.example.com", true, map[string]string{"team": "storage"}),
+		},
+		{
+			name: "spec",
+			old:  makeCSIDriver("csi.example.com", false, nil),
+			new:  withPodInfoOnMountVersion(makeCSIDriver("csi.example.com", true, nil), "v1"),
+			expected: []string{
+				"spec.attachRequired: false -> true",
+				`spec.podInfoOnMountVersion: "" -> "v1"`,
+			},
+		},
+		{
+			name: "unset spec",
+			old: func() *k8scsi.CSIDriver {
+				csiDriver := makeCSIDriver("csi.example.com", true, nil)
+				csiDriver.Spec = k8scsi.CSIDriverSpec{}
+				return csiDriver
+			}(),
+			new: makeCSIDriver("csi.example.com", true, nil),
+			expected: []string{
+				"spec.attachRequired: <unset> -> true",
+				`spec.podInfoOnMountVersion: <unset> -> ""`,
+			},
+		},
+		{
+			name: "metadata",
+			old: withAnnotations(makeCSIDriver("csi.example.com", true, map[string]string{"other": "x", "team": "network"}),
+				map[string]string{"removed": "y"}),
+			new: withAnnotations(makeCSIDriver("csi.example.com", true, map[string]string{"other": "x", "team": "storage"}),
+				map[string]string{"added": "z"}),
+			expected: []string{
+				`labels[team]: "network" -> "storage"`,
+				`annotations[added]: <unset> -> "z"`,
+				`annotations[removed]: "y" -> <unset>`,
+			},
+		},
+	}
+
+	for _, test := range tests {
+		diff := csiDriverDiff(test.old, test.new)
+		if !reflect.DeepEqual(diff, test.expected) {
+			t.Errorf("test %q: expected %q, got %q", test.name, test.expected, diff)
+		}
+	}
+}
+
+// errImmutable is returned by the API server for an update of an
+// immutable field.
+var errImmutable = apierrors.NewInvalid(k8scsi.SchemeGroupVersion.WithKind("CSIDriver").GroupKind(), "csi.example.com", field.ErrorList{
+	field.Invalid(field.NewPath("spec", "attachRequired"), true, "field is immutable"),
+})
+
+func TestVerifyAndAddCSIDriverInfo(t *testing.T) {
+	tests := []struct {
+		name            string
+		existing        []*k8scsi.CSIDriver
+		desired         *k8scsi.CSIDriver
+		getErr          error
+		createErr       error
+		updateErr       error
+		respectExisting bool
+		allowRecreate   bool
+		expectError     bool
+		expectedCreates int
+		expectedUpdates int
+		expectedDeletes int
+		expectedObject  *k8scsi.CSIDriver
+	}{
+		{
+			name:            "create",
+			desired:         makeCSIDriver("csi.example.com", true, nil),
+			expectedCreates: 1,
+			expectedObject:  withCreatedBy(makeCSIDriver("csi.example.com", true, nil)),
+		},
+		{
+			name:           "already exists",
+			existing:       []*k8scsi.CSIDriver{makeCSIDriver("csi.example.com", true, nil)},
+			desired:        makeCSIDriver("csi.example.com", true, nil),
+			expectedObject: makeCSIDriver("csi.example.com", true, nil),
+		},
+		{
+			name:            "spec drift",
+			existing:        []*k8scsi.CSIDriver{makeCSIDriver("csi.example.com", false, nil)},
+			desired:         makeCSIDriver("csi.example.com", true, nil),
+			expectedUpdates: 1,
+			expectedObject:  makeCSIDriver("csi.example.com", true, nil),
+		},
+		{
+			name:            "pod info drift",
+			existing:        []*k8scsi.CSIDriver{makeCSIDriver("csi.example.com", true, nil)},
+			desired:         withPodInfoOnMountVersion(makeCSIDriver("csi.example.com", true, nil), "v1"),
+			expectedUpdates: 1,
+			expectedObject:  withPodInfoOnMountVersion(makeCSIDriver("csi.example.com", true, nil), "v1"),
+		},
+		{
+			name:            "keep other labels",
+			existing:        []*k8scsi.CSIDriver{makeCSIDriver("csi.example.com", true, map[string]string{"other": "x"})},
+			desired:         makeCSIDriver("csi.example.com", true, map[string]string{"team": "storage"}),
+			expectedUpdates: 1,
+			expectedObject:  makeCSIDriver("csi.example.com", true, map[string]string{"other": "x", "team": "storage"}),
+		},
+		{
+			name: "label removed by someone else",
+			existing: []*k8scsi.CSIDriver{withAnnotations(makeCSIDriver("csi.example.com", true, map[string]string{"other": "x"}),
+				map[string]string{versionAnnotation: "test"})},
+			desired: withAnnotations(makeCSIDriver("csi.example.com", true, map[string]string{"team": "storage"}),
+				map[string]string{versionAnnotation: "test"}),
+			respectExisting: true,
+			expectedUpdates: 1,
+			expectedObject: withAnnotations(makeCSIDriver("csi.example.com", true, map[string]string{"other": "x", "team": "storage"}),
+				map[string]string{versionAnnotation: "test"}),
+		},
+		{
+			name: "annotation removed by someone else",
+			existing: []*k8scsi.CSIDriver{withAnnotations(makeManagedCSIDriver("csi.example.com", true, nil),
+				map[string]string{"third-party": "y"})},
+			desired: withAnnotations(makeManagedCSIDriver("csi.example.com", true, nil),
+				map[string]string{"example.com/owner": "storage"}),
+			respectExisting: true,
+			expectedUpdates: 1,
+			expectedObject: withAnnotations(makeManagedCSIDriver("csi.example.com", true, nil),
+				map[string]string{"third-party": "y", "example.com/owner": "storage"}),
+		},
+		{
+			name:            "external object",
+			existing:        []*k8scsi.CSIDriver{makeCSIDriver("csi.example.com", false, nil)},
+			desired:         makeCSIDriver("csi.example.com", true, nil),
+			respectExisting: true,
+			expectedObject:  makeCSIDriver("csi.example.com", false, nil),
+		},
+		{
+			name:            "own object",
+			existing:        []*k8scsi.CSIDriver{makeManagedCSIDriver("csi.example.com", false, nil)},
+			desired:         makeManagedCSIDriver("csi.example.com", true, nil),
+			respectExisting: true,
+			expectedUpdates: 1,
+			expectedObject:  makeManagedCSIDriver("csi.example.com", true, nil),
+		},
+		{
+			name:            "object owned by someone else",
+			existing:        []*k8scsi.CSIDriver{makeManagedCSIDriver("csi.example.com", false, &metav1.OwnerReference{Kind: "Deployment", Name: "other"})},
+			desired:         makeManagedCSIDriver("csi.example.com", true, nil),
+			respectExisting: true,
+			expectedObject:  makeManagedCSIDriver("csi.example.com", false, &metav1.OwnerReference{Kind: "Deployment", Name: "other"}),
+		},
+		{
+			name:        "get error",
+			desired:     makeCSIDriver("csi.example.com", true, nil),
+			getErr:      fmt.Errorf("mock error"),
+			expectError: true,
+		},
+		{
+			name:        "create error",
+			desired:     makeCSIDriver("csi.example.com", true, nil),
+			createErr:   apierrors.NewAlreadyExists(csiDriverResource, "csi.example.com"),
+			expectError: true,
+		},
+		{
+			name:        "create forbidden",
+			desired:     makeCSIDriver("csi.example.com", true, nil),
+			createErr:   apierrors.NewForbidden(csiDriverResource, "csi.example.com", fmt.Errorf("mock error")),
+			expectError: true,
+		},
+		{
+			name:        "update error",
+			existing:    []*k8scsi.CSIDriver{makeCSIDriver("csi.example.com", false, nil)},
+			desired:     makeCSIDriver("csi.example.com", true, nil),
+			updateErr:   fmt.Errorf("mock error"),
+			expectError: true,
+		},
+		{
+			name:           "immutable field",
+			existing:       []*k8scsi.CSIDriver{makeCSIDriver("csi.example.com", false, nil)},
+			desired:        makeCSIDriver("csi.example.com", true, nil),
+			updateErr:      errImmutable,
+			expectError:    true,
+			expectedObject: makeCSIDriver("csi.example.com", false, nil),
+		},
+		{
+			name:            "immutable field, recreate",
+			existing:        []*k8scsi.CSIDriver{makeCSIDriver("csi.example.com", false, nil)},
+			desired:         makeCSIDriver("csi.example.com", true, nil),
+			updateErr:       errImmutable,
+			allowRecreate:   true,
+			expectedDeletes: 1,
+			expectedCreates: 1,
+			expectedObject:  withCreatedBy(makeCSIDriver("csi.example.com", true, nil)),
+		},
+	}
+
+	for _, test := range tests {
+		registrar := newFakeRegistrar(test.existing...)
+		registrar.getErr = test.getErr
+		registrar.createErr = test.createErr
+		registrar.updateErr = test.updateErr
+
+		err := verifyAndAddCSIDriverInfo(context.Background(), registrar, test.desired, false, test.respectExisting, test.allowRecreate)
+		if test.expectError && err == nil {
+			t.Errorf("test %q: Expected error, got none", test.name)
+		}
+		if !test.expectError && err != nil {
+			t.Errorf("test %q: got error: %v", test.name, err)
+		}
+		if registrar.creates != test.expectedCreates {
+			t.Errorf("test %q: expected %d creates, got %d", test.name, test.expectedCreates, registrar.creates)
+		}
+		if registrar.updates != test.expectedUpdates {
+			t.Errorf("test %q: expected %d updates, got %d", test.name, test.expectedUpdates, registrar.updates)
+		}
+		if registrar.deletes != test.expectedDeletes {
+			t.Errorf("test %q: expected %d deletes, got %d", test.name, test.expectedDeletes, registrar.deletes)
+		}
+		if test.expectedObject != nil {
+			obj := registrar.objects[test.expectedObject.Name]
+			if !reflect.DeepEqual(obj, test.expectedObject) {
+				t.Errorf("test %q: expected object %+v, got %+v", test.name, test.expectedObject, obj)
+			}
+		}
+	}
+}
+
+func TestVerifyAndDeleteCSIDriverInfo(t *testing.T) {
+	tests := []struct {
+		name            string
+		existing        []*k8scsi.CSIDriver
+		deleteOnlyOwned bool
+		getErr          error
+		deleteErr       error
+		expectError     bool
+		expectedDeletes int
+	}{
+		{
+			name:            "delete",
+			existing:        []*k8scsi.CSIDriver{makeCSIDriver("csi.example.com", true, nil)},
+			expectedDeletes: 1,
+		},
+		{
+			name: "not found",
+		},
+		{
+			name:            "own object",
+			existing:        []*k8scsi.CSIDriver{withCreatedBy(makeManagedCSIDriver("csi.example.com", true, nil))},
+			deleteOnlyOwned: true,
+			expectedDeletes: 1,
+		},
+		{
+			name:            "external object",
+			existing:        []*k8scsi.CSIDriver{makeCSIDriver("csi.example.com", true, nil)},
+			deleteOnlyOwned: true,
+		},
+		{
+			// Updating an object adds versionAnnotation, that
+			// alone does not make it owned.
+			name:            "updated external object",
+			existing:        []*k8scsi.CSIDriver{makeManagedCSIDriver("csi.example.com", true, nil)},
+			deleteOnlyOwned: true,
+		},
+		{
+			name:            "object owned by someone else",
+			existing:        []*k8scsi.CSIDriver{withCreatedBy(makeManagedCSIDriver("csi.example.com", true, &metav1.OwnerReference{Kind: "Deployment", Name: "other"}))},
+			deleteOnlyOwned: true,
+		},
+		{
+			name:            "only owned, not found",
+			deleteOnlyOwned: true,
+		},
+		{
+			name:            "only owned, get error",
+			existing:        []*k8scsi.CSIDriver{withCreatedBy(makeManagedCSIDriver("csi.example.com", true, nil))},
+			deleteOnlyOwned: true,
+			getErr:          fmt.Errorf("mock error"),
+			expectError:     true,
+		},
+		{
+			name:        "delete forbidden",
+			existing:    []*k8scsi.CSIDriver{makeCSIDriver("csi.example.com", true, nil)},
+			deleteErr:   apierrors.NewForbidden(csiDriverResource, "csi.example.com", fmt.Errorf("mock error")),
+			expectError: true,
+		},
+		{
+			name:        "delete error",
+			existing:    []*k8scsi.CSIDriver{makeCSIDriver("csi.example.com", true, nil)},
+			deleteErr:   fmt.Errorf("mock error"),
+			expectError: true,
+		},
+	}
+
+	for _, test := range tests {
+		registrar := newFakeRegistrar(test.existing...)
+		registrar.getErr = test.getErr
+		registrar.deleteErr = test.deleteErr
+
+		err := verifyAndDeleteCSIDriverInfo(context.Background(), registrar, makeManagedCSIDriver("csi.example.com", true, nil), test.deleteOnlyOwned)
+		if test.expectError && err == nil {
+			t.Errorf("test %q: Expected error, got none", test.name)
+		}
+		if !test.expectError && err != nil {
+			t.Errorf("test %q: got error: %v", test.name, err)
+		}
+		if registrar.deletes != test.expectedDeletes {
+			t.Errorf("test %q: expected %d deletes, got %d", test.name, test.expectedDeletes, registrar.deletes)
+		}
+	}
+}
+
+// TestDeleteOnlyOwnedAfterUpdate covers the full lifecycle of an object
+// which someone else created: the registrar updates it, but must not
+// delete it with --delete-only-owned.
+func TestDeleteOnlyOwnedAfterUpdate(t *testing.T) {
+	registrar := newFakeRegistrar(makeCSIDriver("csi.example.com", false, nil))
+	desired := makeManagedCSIDriver("csi.example.com", true, nil)
+
+	if err := verifyAndAddCSIDriverInfo(context.Background(), registrar, desired, false, false, false); err != nil {
+		t.Fatalf("registration failed: %v", err)
+	}
+	if registrar.updates != 1 {
+		t.Fatalf("expected 1 update, got %d", registrar.updates)
+	}
+	if _, ok := registrar.objects["csi.example.com"].Annotations[createdByAnnotation]; ok {
+		t.Errorf("update added the %s annotation", createdByAnnotation)
+	}
+
+	if err := verifyAndDeleteCSIDriverInfo(context.Background(), registrar, desired, true); err != nil {
+		t.Fatalf("cleanup failed: %v", err)
+	}
+	if _, ok := registrar.objects["csi.example.com"]; !ok {
+		t.Error("object created by someone else was deleted")
+	}
+}
+
+func TestCSIDriverWatcher(t *testing.T) {
+	tests := []struct {
+		name          string
+		event         *watch.EventType
+		watchErr      error
+		expectTimeout bool
+	}{
+		{
+			name:  "deleted",
+			event: eventType(watch.Deleted),
+		},
+		{
+			name:  "modified",
+			event: eventType(watch.Modified),
+		},
+		{
+			name:          "added",
+			event:         eventType(watch.Added),
+			expectTimeout: true,
+		},
+		{
+			name:          "no event",
+			expectTimeout: true,
+		},
+		{
+			name:          "watch error",
+			watchErr:      fmt.Errorf("mock error"),
+			expectTimeout: true,
+		},
+	}
+
+	resyncPeriod := 100 * time.Millisecond
+	for _, test := range tests {
+		registrar := newFakeRegistrar()
+		registrar.watchErr = test.watchErr
+		if test.event != nil {
+			registrar.watcher.Action(*test.event, makeCSIDriver("csi.example.com", true, nil))
+		}
+		watcher := &csiDriverWatcher{registrar: registrar, name: "csi.example.com", clock: clock.RealClock{}}
+
+		start := time.Now()
+		watcher.wait(context.Background(), resyncPeriod)
+		timedOut := time.Since(start) >= resyncPeriod
+		if timedOut != test.expectTimeout {
+			t.Errorf("test %q: expected timeout %t, got %t", test.name, test.expectTimeout, timedOut)
+		}
+		deleted := test.event != nil && *test.event == watch.Deleted
+		if watcher.deleted != deleted {
+			t.Errorf("test %q: expected deleted %t, got %t", test.name, deleted, watcher.deleted)
+		}
+	}
+}
+
+func eventType(t watch.EventType) *watch.EventType {
+	return &t
+}
+
+func TestRetryUntilDeadline(t *testing.T) {
+	conflict := apierrors.NewConflict(csiDriverResource, "csi.example.com", fmt.Errorf("mock error"))
+	tests := []struct {
+		name        string
+		err         error
+		failures    int
+		expectError bool
+		minCalls    int
+		maxCalls    int
+	}{
+		{
+			name:     "success",
+			minCalls: 1,
+			maxCalls: 1,
+		},
+		{
+			name:     "conflicts",
+			err:      conflict,
+			failures: 5,
+			minCalls: 6,
+			maxCalls: 6,
+		},
+		{
+			name:        "not retriable",
+			err:         apierrors.NewForbidden(csiDriverResource, "csi.example.com", fmt.Errorf("mock error")),
+			failures:    5,
+			expectError: true,
+			minCalls:    1,
+			maxCalls:    1,
+		},
+		{
+			// Continues beyond the three steps of the backoff
+			// until the deadline.
+			name:        "deadline",
+			err:         conflict,
+			failures:    1000,
+			expectError: true,
+			minCalls:    4,
+			maxCalls:    100,
+		},
+	}
+
+	backoff := wait.Backoff{Steps: 3, Duration: time.Millisecond, Factor: 2.0}
+	for _, test := range tests {
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		calls := 0
+		err := retryUntilDeadline(ctx, backoff, isRetriable, func() error {
+			calls++
+			if calls <= test.failures {
+				return test.err
+			}
+			return nil
+		})
+		if test.expectError {
+			// The last API error, not the context error.
+			if err != test.err {
+				t.Errorf("test %q: expected error %v, got %v", test.name, test.err, err)
+			}
+		} else if err != nil {
+			t.Errorf("test %q: got error: %v", test.name, err)
+		}
+		if calls < test.minCalls || calls > test.maxCalls {
+			t.Errorf("test %q: expected %d to %d calls, got %d", test.name, test.minCalls, test.maxCalls, calls)
+		}
+		cancel()
+	}
+}
+
+func TestRetryOnError(t *testing.T) {
+	tests := []struct {
+		name          string
+		err           error
+		failures      int
+		expectError   bool
+		expectedCalls int
+	}{
+		{
+			name:          "success",
+			expectedCalls: 1,
+		},
+		{
+			name:          "conflict",
+			err:           apierrors.NewConflict(csiDriverResource, "csi.example.com", fmt.Errorf("mock error")),
+			failures:      2,
+			expectedCalls: 3,
+		},
+		{
+			name:          "server timeout",
+			err:           apierrors.NewServerTimeout(csiDriverResource, "get", 1),
+			failures:      2,
+			expectedCalls: 3,
+		},
+		{
+			name:          "too many requests",
+			err:           apierrors.NewTooManyRequests("mock error", 1),
+			failures:      2,
+			expectedCalls: 3,
+		},
+		{
+			name:          "internal error",
+			err:           apierrors.NewInternalError(fmt.Errorf("mock error")),
+			failures:      2,
+			expectedCalls: 3,
+		},
+		{
+			name:          "not retriable",
+			err:           apierrors.NewForbidden(csiDriverResource, "csi.example.com", fmt.Errorf("mock error")),
+			failures:      2,
+			expectError:   true,
+			expectedCalls: 1,
+		},
+		{
+			name:          "retries exhausted",
+			err:           apierrors.NewInternalError(fmt.Errorf("mock error")),
+			failures:      10,
+			expectError:   true,
+			expectedCalls: 3,
+		},
+	}
+
+	backoff := wait.Backoff{Steps: 3, Duration: time.Millisecond, Factor: 1.0}
+	for _, test := range tests {
+		calls := 0
+		err := retryOnError(backoff, isRetriable, func() error {
+			calls++
+			if calls <= test.failures {
+				return test.err
+			}
+			return nil
+		})
+		if test.expectError && err == nil {
+			t.Errorf("test %q: Expected error, got none", test.name)
+		}
+		if !test.expectError && err != nil {
+			t.Errorf("test %q: got error: %v", test.name, err)
+		}
+		if calls != test.expectedCalls {
+			t.Errorf("test %q: expected %d calls, got %d", test.name, test.expectedCalls, calls)
+		}
+	}
+}
+
+func TestUpdateDriverVersion(t *testing.T) {
+	tests := []struct {
+		name            string
+		annotations     map[string]string
+		csiConn         *fakeCSIConnection
+		expectedVersion string
+	}{
+		{
+			name:            "initial",
+			csiConn:         &fakeCSIConnection{version: "1.0.0"},
+			expectedVersion: "1.0.0",
+		},
+		{
+			name:            "upgrade",
+			annotations:     map[string]string{driverVersionAnnotation: "1.0.0"},
+			csiConn:         &fakeCSIConnection{version: "1.1.0"},
+			expectedVersion: "1.1.0",
+		},
+		{
+			name:            "CSI error",
+			annotations:     map[string]string{driverVersionAnnotation: "1.0.0"},
+			csiConn:         &fakeCSIConnection{err: fmt.Errorf("mock error")},
+			expectedVersion: "1.0.0",
+		},
+	}
+
+	for _, test := range tests {
+		csiDriver := makeCSIDriver("csi.example.com", true, nil)
+		csiDriver.Annotations = test.annotations
+		updateDriverVersion(context.Background(), test.csiConn, time.Second, csiDriver)
+		if version := csiDriver.Annotations[driverVersionAnnotation]; version != test.expectedVersion {
+			t.Errorf("test %q: expected version %q, got %q", test.name, test.expectedVersion, version)
+		}
+	}
+}
+
+func TestMergeMap(t *testing.T) {
+	tests := []struct {
+		name     string
+		base     map[string]string
+		src      map[string]string
+		expected map[string]string
+	}{
+		{
+			name: "empty",
+			base: map[string]string{},
+		},
+		{
+			name:     "only base",
+			base:     map[string]string{"a": "1"},
+			expected: map[string]string{"a": "1"},
+		},
+		{
+			name:     "only src",
+			src:      map[string]string{"b": "2"},
+			expected: map[string]string{"b": "2"},
+		},
+		{
+			name:     "src takes precedence",
+			base:     map[string]string{"a": "1", "b": "1"},
+			src:      map[string]string{"b": "2"},
+			expected: map[string]string{"a": "1", "b": "2"},
+		},
+	}
+
+	for _, test := range tests {
+		merged := mergeMap(test.base, test.src)
+		if !reflect.DeepEqual(merged, test.expected) {
+			t.Errorf("test %q: expected %v, got %v", test.name, test.expected, merged)
+		}
+		if merged != nil {
+			merged["changed"] = "true"
+		}
+		if _, ok := test.base["changed"]; ok {
+			t.Errorf("test %q: result shares base", test.name)
+		}
+	}
+}
+
+func TestFailureBackoff(t *testing.T) {
+	backoff := &failureBackoff{base: time.Minute, max: 5 * time.Minute}
+	steps := []struct {
+		failed   bool
+		expected time.Duration
+	}{
+		{false, time.Minute},
+		{true, time.Minute},
+		{true, 2 * time.Minute},
+		{true, 4 * time.Minute},
+		{true, 5 * time.Minute},
+		{true, 5 * time.Minute},
+		{false, time.Minute},
+		{true, time.Minute},
+	}
+
+	for i, step := range steps {
+		delay := backoff.next(step.failed)
+		// Up to 10% jitter gets added after failures.
+		max := step.expected
+		if step.failed {
+			max += step.expected / 10
+		}
+		if delay < step.expected || delay > max {
+			t.Errorf("step %d: expected delay between %v and %v, got %v", i, step.expected, max, delay)
+		}
+	}
+}
+
+func TestFailureBackoffPermanent(t *testing.T) {
+	backoff := &failureBackoff{base: time.Minute, max: 5 * time.Minute}
+	delay := backoff.permanentFailure()
+	if delay < 5*time.Minute || delay > 5*time.Minute+30*time.Second {
+		t.Errorf("expected maximum delay after permanent failure, got %v", delay)
+	}
+	if delay := backoff.next(false); delay != time.Minute {
+		t.Errorf("expected base delay after success, got %v", delay)
+	}
+}
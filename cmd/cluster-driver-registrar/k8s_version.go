@@ -0,0 +1,110 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/golang/glog"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/discovery"
+)
+
+// The CSIDriver CRD is supported since Kubernetes 1.12.
+const defaultMinK8sVersion = "1.12"
+
+var majorMinorRE = regexp.MustCompile(`^v?(\d+)\.(\d+)`)
+
+// parseMajorMinor extracts major and minor version from strings like
+// "1.12" or "v1.12.3-gke.1".
+func parseMajorMinor(version string) (int, int, error) {
+	match := majorMinorRE.FindStringSubmatch(version)
+	if match == nil {
+		return 0, 0, fmt.Errorf("%q is not a Kubernetes version of the form <major>.<minor>", version)
+	}
+	major, _ := strconv.Atoi(match[1])
+	minor, _ := strconv.Atoi(match[2])
+	return major, minor, nil
+}
+
+// checkServerVersion returns an error if the API server is older than
+// minVersion.
+func checkServerVersion(client discovery.ServerVersionInterface, minVersion string) error {
+	minMajor, minMinor, err := parseMajorMinor(minVersion)
+	if err != nil {
+		return err
+	}
+	info, err := client.ServerVersion()
+	if err != nil {
+		return fmt.Errorf("failed to get Kubernetes server version: %v", err)
+	}
+	major, minor, err := parseMajorMinor(info.GitVersion)
+	if err != nil {
+		return fmt.Errorf("unexpected Kubernetes server version: %v", err)
+	}
+	if major < minMajor || major == minMajor && minor < minMinor {
+		return fmt.Errorf("Kubernetes server version %s is too old, CSIDriver objects require at least %d.%d; upgrade the cluster", info.GitVersion, minMajor, minMinor)
+	}
+	return nil
+}
+
+// resourceAvailable checks whether the API server serves the resource
+// in the given group version.
+func resourceAvailable(client discovery.ServerResourcesInterface, groupVersion, resource string) (bool, error) {
+	resources, err := client.ServerResourcesForGroupVersion(groupVersion)
+	if apierrors.IsNotFound(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	for _, r := range resources.APIResources {
+		if r.Name == resource {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// waitForResource polls discovery until the API server serves the
+// resource or the timeout has passed. Errors are retried, too, because
+// the API server may still be busy installing a new API.
+func waitForResource(client discovery.ServerResourcesInterface, groupVersion, resource string, interval, timeout time.Duration) error {
+	var lastErr error
+	err := wait.PollImmediate(interval, timeout, func() (bool, error) {
+		available, err := resourceAvailable(client, groupVersion, resource)
+		if err != nil {
+			glog.V(4).Infof("Checking for %s in %s failed, retrying: %v", resource, groupVersion, err)
+			lastErr = err
+			return false, nil
+		}
+		if !available {
+			glog.V(2).Infof("API server does not serve %s in %s yet", resource, groupVersion)
+		}
+		return available, nil
+	})
+	if err == wait.ErrWaitTimeout {
+		if lastErr != nil {
+			return fmt.Errorf("API server did not serve %s in %s within %v: %v", resource, groupVersion, timeout, lastErr)
+		}
+		return fmt.Errorf("API server did not serve %s in %s within %v", resource, groupVersion, timeout)
+	}
+	return err
+}
@@ -0,0 +1,179 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	k8sversion "k8s.io/apimachinery/pkg/version"
+	"k8s.io/client-go/discovery"
+)
+
+type fakeServerVersion struct {
+	gitVersion string
+	err        error
+}
+
+func (f fakeServerVersion) ServerVersion() (*k8sversion.Info, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+	return &k8sversion.Info{GitVersion: f.gitVersion}, nil
+}
+
+func TestCheckServerVersion(t *testing.T) {
+	tests := []struct {
+		name        string
+		server      fakeServerVersion
+		minVersion  string
+		expectError bool
+	}{
+		{
+			name:       "same version",
+			server:     fakeServerVersion{gitVersion: "v1.12.0"},
+			minVersion: "1.12",
+		},
+		{
+			name:       "newer minor",
+			server:     fakeServerVersion{gitVersion: "v1.13.1-gke.2"},
+			minVersion: "1.12",
+		},
+		{
+			name:       "newer major",
+			server:     fakeServerVersion{gitVersion: "v2.0.0"},
+			minVersion: "1.12",
+		},
+		{
+			name:        "too old",
+			server:      fakeServerVersion{gitVersion: "v1.11.5"},
+			minVersion:  "1.12",
+			expectError: true,
+		},
+		{
+			name:        "invalid server version",
+			server:      fakeServerVersion{gitVersion: "unknown"},
+			minVersion:  "1.12",
+			expectError: true,
+		},
+		{
+			name:        "invalid minimum",
+			server:      fakeServerVersion{gitVersion: "v1.12.0"},
+			minVersion:  "twelve",
+			expectError: true,
+		},
+		{
+			name:        "server error",
+			server:      fakeServerVersion{err: fmt.Errorf("mock error")},
+			minVersion:  "1.12",
+			expectError: true,
+		},
+	}
+
+	for _, test := range tests {
+		err := checkServerVersion(test.server, test.minVersion)
+		if test.expectError && err == nil {
+			t.Errorf("test %q: Expected error, got none", test.name)
+		}
+		if !test.expectError && err != nil {
+			t.Errorf("test %q: got error: %v", test.name, err)
+		}
+	}
+}
+
+// fakeServerResources returns the next of its results for each call
+// and repeats the last one when it runs out.
+type fakeServerResources struct {
+	discovery.ServerResourcesInterface
+	results []fakeServerResourcesResult
+	calls   int
+}
+
+type fakeServerResourcesResult struct {
+	resources []string
+	err       error
+}
+
+func (f *fakeServerResources) ServerResourcesForGroupVersion(groupVersion string) (*metav1.APIResourceList, error) {
+	result := f.results[len(f.results)-1]
+	if f.calls < len(f.results) {
+		result = f.results[f.calls]
+	}
+	f.calls++
+	if result.err != nil {
+		return nil, result.err
+	}
+	list := &metav1.APIResourceList{GroupVersion: groupVersion}
+	for _, resource := range result.resources {
+		list.APIResources = append(list.APIResources, metav1.APIResource{Name: resource})
+	}
+	return list, nil
+}
+
+func TestWaitForResource(t *testing.T) {
+	notFound := apierrors.NewNotFound(schema.GroupResource{}, "")
+	tests := []struct {
+		name          string
+		results       []fakeServerResourcesResult
+		expectError   bool
+		expectedCalls int
+	}{
+		{
+			name:          "available",
+			results:       []fakeServerResourcesResult{{resources: []string{"csidrivers"}}},
+			expectedCalls: 1,
+		},
+		{
+			name: "appears later",
+			results: []fakeServerResourcesResult{
+				{err: notFound},
+				{err: fmt.Errorf("mock error")},
+				{resources: []string{"csinodeinfos"}},
+				{resources: []string{"csidrivers", "csinodeinfos"}},
+			},
+			expectedCalls: 4,
+		},
+		{
+			name:        "never available",
+			results:     []fakeServerResourcesResult{{err: notFound}},
+			expectError: true,
+		},
+		{
+			name:        "always failing",
+			results:     []fakeServerResourcesResult{{err: fmt.Errorf("mock error")}},
+			expectError: true,
+		},
+	}
+
+	for _, test := range tests {
+		client := &fakeServerResources{results: test.results}
+		err := waitForResource(client, "csi.storage.k8s.io/v1alpha1", "csidrivers", time.Millisecond, 100*time.Millisecond)
+		if test.expectError && err == nil {
+			t.Errorf("test %q: Expected error, got none", test.name)
+		}
+		if !test.expectError && err != nil {
+			t.Errorf("test %q: got error: %v", test.name, err)
+		}
+		if test.expectedCalls > 0 && client.calls != test.expectedCalls {
+			t.Errorf("test %q: expected %d discovery calls, got %d", test.name, test.expectedCalls, client.calls)
+		}
+	}
+}
@@ -20,11 +20,31 @@ import (
 	"context"
 	"flag"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"net/url"
 	"os"
+	"os/signal"
+	"strings"
+	"sync"
 	"time"
 
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/ghodss/yaml"
 	"github.com/golang/glog"
+	"google.golang.org/grpc/credentials"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/clock"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	utilnet "k8s.io/apimachinery/pkg/util/net"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/client-go/discovery"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
 	k8scsi "k8s.io/csi-api/pkg/apis/csi/v1alpha1"
@@ -33,16 +53,53 @@ import (
 )
 
 const (
-	// Default timeout of short CSI calls like GetPluginInfo
-	csiTimeout = time.Second
+	// Backoff for retrying the initial connection to the CSI driver.
+	initialRetryDelay = time.Second
+	maxRetryDelay     = 30 * time.Second
 
-	// Verify (and update, if needed) the node ID at this freqeuency.
-	sleepDuration = 2 * time.Minute
+	// Time between discovery calls for --wait-for-crd.
+	crdPollInterval = 2 * time.Second
+
+	// Polling of a new CSIDriver object for --confirm-registration.
+	confirmInterval = 100 * time.Millisecond
+	confirmTimeout  = 10 * time.Second
+
+	// Annotation on the CSIDriver object which records the version of
+	// the registrar that created or last updated it.
+	versionAnnotation = "csi.storage.k8s.io/cluster-driver-registrar-version"
+
+	// Annotation which marks a CSIDriver object as created by the
+	// registrar. Unlike versionAnnotation, it is only set when
+	// creating the object and never added to an existing one.
+	createdByAnnotation = "csi.storage.k8s.io/created-by-cluster-driver-registrar"
+
+	// Annotation on the CSIDriver object which records the vendor
+	// version reported by the CSI driver.
+	driverVersionAnnotation = "csi.storage.k8s.io/driver-version"
+
+	// Interval between Probe calls while waiting for the driver to
+	// become ready.
+	probeInterval = time.Second
+
+	// Used when no --csi-address is given.
+	defaultCSIAddress = "/run/csi/socket"
 )
 
 // Command line flags
 var (
-	kubeconfig               = flag.String("kubeconfig", "", "Absolute path to the kubeconfig file. Required only when running out of cluster.")
+	objectNameSuffix         = flag.String("csidriver-resource-name-suffix", "", "Suffix appended to the name of the CSIDriver object, for example to avoid collisions when the same driver is registered from several management contexts. The driver name without the suffix is still used to identify the driver, for example for the node ID. Kubernetes only finds the CSIDriver object of a driver under its exact name, so this is only useful for consumers that know about the suffix. The default is empty string, which means no suffix.")
+	driverNameOverride       = flag.String("driver-name-override", "", "Name for the CSIDriver object. The default is empty string, which means that the name reported by the CSI driver is used.")
+	verboseCapabilities      = flag.Bool("verbose-capabilities", false, "Log all controller capabilities reported by the CSI driver at startup.")
+	driverNameManifestKey    = flag.String("driver-name-manifest-key", "", "Key in the manifest returned by the CSI driver's GetPluginInfo whose value is used as the driver name. The name reported by the driver is used if the key is not in the manifest. The default is empty string, which means the reported name is always used.")
+	configFile               = flag.String("config", "", "Path to a YAML file with settings for the CSIDriver object. Command line flags take precedence over values from the file.")
+	kubeconfig               = flag.String("kubeconfig", "", "Absolute path to the kubeconfig file. Takes precedence over the KUBECONFIG environment variable and ~/.kube/config. Without any of them, the in-cluster configuration is used.")
+	master                   = flag.String("master", "", "URL of the Kubernetes API server. If set, neither a kubeconfig file nor the in-cluster configuration is used. Cannot be combined with --kubeconfig.")
+	tokenFile                = flag.String("token-file", "", "File with the bearer token for authenticating to the API server given with --master.")
+	minK8sVersion            = flag.String("min-k8s-version", defaultMinK8sVersion, "Minimum Kubernetes version of the API server, as <major>.<minor>. The registrar exits with an error on older clusters. Empty disables the check.")
+	kubeAPIProxyURL          = flag.String("kube-api-proxy-url", "", "URL of an HTTP(S) proxy for the connection to the Kubernetes API server. The default is empty string, which means the HTTP_PROXY, HTTPS_PROXY and NO_PROXY environment variables are used.")
+	userAgent                = flag.String("user-agent", "", "User agent for requests to the Kubernetes API server. The default is empty string, which means csi-cluster-driver-registrar/<version> is used.")
+	kubeAPIQPS               = flag.Float64("kube-api-qps", 0, "QPS to use while communicating with the Kubernetes API server. The default is 0, which means the client-go default is used.")
+	kubeAPIBurst             = flag.Int("kube-api-burst", 0, "Burst to use while communicating with the Kubernetes API server. The default is 0, which means the client-go default is used.")
 	k8sPodInfoOnMountVersion = flag.String("pod-info-mount-version",
 		"",
 		"This indicates that the associated CSI volume driver"+
@@ -53,14 +110,67 @@ var (
 			"- csi.storage.k8s.io/pod.namespace: pod.Namespace\n"+
 			"- csi.storage.k8s.io/pod.uid: string(pod.UID)",
 	)
-	connectionTimeout = flag.Duration("connection-timeout", 1*time.Minute, "Timeout for waiting for CSI driver socket.")
-	csiAddress        = flag.String("csi-address", "/run/csi/socket", "Address of the CSI driver socket.")
-	showVersion       = flag.Bool("version", false, "Show version.")
-	version           = "unknown"
-	// List of supported versions
-	supportedVersions = []string{"1.0.0"}
+	connectionTimeout      = flag.Duration("connection-timeout", 1*time.Minute, "Timeout for waiting for CSI driver socket.")
+	keepaliveTime          = flag.Duration("keepalive-time", 5*time.Minute, "Send a keepalive ping to the CSI driver during calls after this much time without activity, to detect broken connections. Values below the keepalive enforcement policy of the driver (5m for default gRPC servers) may cause the driver to close the connection. 0 disables keepalive.")
+	keepaliveTimeout       = flag.Duration("keepalive-timeout", 20*time.Second, "Time to wait for the response to a keepalive ping before the connection to the CSI driver is considered broken and re-established.")
+	connectionRetryTimeout = flag.Duration("connection-retry-timeout", 1*time.Minute, "Total time for retrying to connect to the CSI driver and to discover its name before giving up.")
+	probeTimeout           = flag.Duration("probe-timeout", 1*time.Minute, "Maximum time for waiting until the CSI driver reports that it is ready.")
+	csiTimeout             = flag.Duration("csi-timeout", time.Second, "Timeout of short CSI calls like GetPluginInfo and ControllerGetCapabilities.")
+	csiTLSCert             = flag.String("csi-tls-cert", "", "PEM encoded client certificate for mutual TLS with the CSI driver. Must be set together with --csi-tls-key. The default is an insecure connection.")
+	csiTLSKey              = flag.String("csi-tls-key", "", "PEM encoded private key of the --csi-tls-cert client certificate.")
+	csiTLSCA               = flag.String("csi-tls-ca", "", "PEM encoded CA certificates for verifying the CSI driver. Enables TLS even without a client certificate. The default is to use the system CAs when TLS is enabled.")
+	ownerRefAPIVersion     = flag.String("owner-ref-api-version", "", "API version of the owner of the CSIDriver object, for example apps/v1. Must be set together with the other --owner-ref flags.")
+	ownerRefKind           = flag.String("owner-ref-kind", "", "Kind of the owner of the CSIDriver object, for example DaemonSet.")
+	ownerRefName           = flag.String("owner-ref-name", "", "Name of the owner of the CSIDriver object.")
+	ownerRefUID            = flag.String("owner-ref-uid", "", "UID of the owner of the CSIDriver object.")
+	verifyNodeID           = flag.Bool("verify-node-id", false, "Get the node ID from the CSI driver at the --resync-period frequency and store it in the csi.volume.kubernetes.io/nodeid annotation of the node given with --node-name whenever it changes.")
+	registerCSINodeInfo    = flag.Bool("register-csinodeinfo", false, "Also store the node ID reported by the CSI driver in the alpha CSINodeInfo object of the node given with --node-name. Skipped if the API server does not serve CSINodeInfo.")
+	nodeName               = flag.String("node-name", "", "Name of the node on which the CSI driver runs. Required for --verify-node-id and --register-csinodeinfo.")
+	respectExisting        = flag.Bool("respect-existing", false, "Do not modify an existing CSIDriver object which appears to be managed by someone else, for example because it was not created by the registrar or is owned by another object.")
+	deleteOnlyOwned        = flag.Bool("delete-only-owned", false, "On termination, only delete the CSIDriver object if it was created by the registrar, as recorded by the csi.storage.k8s.io/created-by-cluster-driver-registrar annotation, and is not owned or managed by someone else.")
+	allowRecreate          = flag.Bool("allow-recreate", false, "Delete and create the CSIDriver object again when it cannot be updated, for example because an immutable field differs. The default is to log an error and leave the object unchanged.")
+	exitOnDelete           = flag.Bool("exit-on-csidriver-delete", false, "Exit with code 2 instead of re-creating the CSIDriver object when a watch detects that it was deleted. Kubernetes then restarts the container, which makes the deletion visible as a restart, but a repeated deletion leads to a crash loop. Without a working watch, a deletion is only noticed at the next resync and the object gets re-created.")
+	cleanupRenamed         = flag.Bool("cleanup-renamed", false, "When the CSI driver reports a different name while running, for example after an upgrade, register the CSIDriver object under the new name and delete the object with the old name if it was created by the registrar. Has no effect when the name is set with --driver-name-override or the configuration file.")
+	skipDeregistration     = flag.Bool("skip-deregistration", false, "Leave the CSIDriver object in place on termination instead of deleting it, for example to avoid disrupting volume operations while the registrar gets restarted during an upgrade. An object with an owner reference set by the --owner-ref flags is still deleted by the Kubernetes garbage collector once the owner is gone.")
+	registerOnce           = flag.Bool("register-once", false, "Create or update the CSIDriver object once and exit instead of keeping it registered. The exit code is non-zero if registration failed. The object is not removed on exit.")
+	fieldManager           = flag.String("field-manager", "csi-cluster-driver-registrar", "Name of the field manager used when creating and patching the CSIDriver object. API servers which track managed fields attribute the fields set by the registrar to this manager. Must not be empty.")
+	selfTest               = flag.Bool("self-test", false, "Connect to the CSI driver, print its name, version, whether attach is required, whether it has volume accessibility constraints (topology) and the CSIDriver object that would be registered to stdout, then exit. The Kubernetes API is not used.")
+	printObject            = flag.Bool("print-object", false, "Connect to the CSI driver, print the CSIDriver object that would be registered as YAML to stdout, then exit. The output can be used as manifest for managing the object without the registrar. The Kubernetes API is not used.")
+	dryRun                 = flag.Bool("dry-run", false, "Discover the CSI driver and log the CSIDriver object that would be registered, then exit without modifying the cluster.")
+	emitEvents             = flag.Bool("emit-events", false, "Record Kubernetes events when the CSIDriver object gets created, updated or deleted.")
+	eventNamespaceFlag     = flag.String("event-namespace", "", "Namespace for the events recorded with --emit-events. The default is the namespace of the registrar, see --namespace.")
+	ownNamespaceFlag       = flag.String("namespace", "", "Namespace of the registrar, used by features which need it, like --emit-events. The default is the namespace of the registrar's own pod or, outside of a cluster, the namespace of the current kubeconfig context. The registrar fails to start when such a feature is enabled and the namespace cannot be determined.")
+	healthPort             = flag.Int("health-port", 0, "TCP port for the /healthz liveness endpoint. The default is 0, which means the endpoint is disabled.")
+	readinessPort          = flag.Int("readiness-port", 0, "TCP port for the /readyz readiness endpoint. It reports ready once the CSIDriver objects were registered successfully. May be the same as --health-port. The default is 0, which means the endpoint is disabled.")
+	healthStaleness        = flag.Duration("health-staleness", 30*time.Second, "The /healthz endpoint probes the CSI driver again if it was last reached longer ago than this.")
+	resyncPeriod           = flag.Duration("resync-period", 2*time.Minute, "Verify (and re-create, if needed) the CSIDriver object at this frequency.")
+	startupJitter          = flag.Duration("startup-jitter", 0, "Wait for a random duration up to this value before registering for the first time, to spread the load on the API server when many registrars start at once. The default is 0, which means no delay.")
+	extraSpecJSON          = flag.String("extra-spec-json", "", "JSON object with additional fields for the spec of the CSIDriver object, for example {\"podInfoOnMountVersion\":\"v1\"}. It is merged into the spec like a JSON merge patch. Fields which the CSIDriver API of the cluster does not support are ignored with a warning. attachRequired cannot be set this way.")
+	strictValidation       = flag.Bool("strict-validation", false, "Reject fields in --extra-spec-json which the CSIDriver API does not support instead of ignoring them.")
+	confirmRegistration    = flag.Bool("confirm-registration", false, "After creating the CSIDriver object, read it back until it is visible before reporting success. Registration fails if it is not visible within 10 seconds and is retried later.")
+	waitForCRD             = flag.Duration("wait-for-crd", 0, "Maximum time to wait for the API server to serve CSIDriver objects after the CRD was registered, for example while the CRD is still being installed. The default is 0, which means no waiting.")
+	objectTimeout          = flag.Duration("object-timeout", time.Minute, "Maximum time for each API call that reads, creates, updates or deletes the CSIDriver object, and for reading and patching the Node object with --verify-node-id. A call that takes longer is abandoned and retried later. 0 disables the timeout.")
+	retrySteps             = flag.Int("retry-steps", registerBackoff.Steps, "Number of attempts for an API call which fails with a conflict or a temporary server error before giving up until the next resync. When removing the CSIDriver object on termination, attempts continue with the last delay until --shutdown-timeout is reached.")
+	retryBaseDuration      = flag.Duration("retry-base-duration", registerBackoff.Duration, "Delay before the first retry of a failed API call, see --retry-steps.")
+	retryFactor            = flag.Float64("retry-factor", registerBackoff.Factor, "Factor by which the delay between retries of a failed API call grows, see --retry-steps.")
+	shutdownTimeout        = flag.Duration("shutdown-timeout", 20*time.Second, "Maximum time for removing the CSIDriver object on termination. The registrar exits with an error if the object could not be removed in time. Should be shorter than the termination grace period of the pod.")
+	maxResyncBackoff       = flag.Duration("max-resync-backoff", 10*time.Minute, "While registering the CSIDriver object keeps failing, the time between attempts doubles from --resync-period up to this maximum. No backoff happens if it is not larger than --resync-period.")
+	metricsAddress         = flag.String("metrics-address", "", "The TCP network address where the Prometheus metrics endpoint will listen (example: `:8080`). The default is empty string, which means the metrics endpoint is disabled.")
+	debugAddress           = flag.String("debug-address", "", "The TCP network address where the pprof debug endpoints under /debug/pprof/ will listen (example: `localhost:6060`). The default is empty string, which means the debug endpoints are disabled.")
+	terminationLogPath     = flag.String("termination-log-path", "/dev/termination-log", "File to which the reason for a failure is written before exiting, so that Kubernetes shows it in the container status. Empty disables writing it.")
+	showVersion            = flag.Bool("version", false, "Show version.")
+	csiAddresses           = stringListFlag{}
+	labels                 = keyValueFlag{}
+	annotations            = keyValueFlag{}
+	version                = "unknown"
 )
 
+func init() {
+	flag.Var(&csiAddresses, "csi-address", "Address of a CSI driver socket. Can be specified more than once to register several CSI drivers, each with its own CSIDriver object. The default is "+defaultCSIAddress+".")
+	flag.Var(labels, "label", "A label of the form key=value that gets added to the CSIDriver object. Can be specified more than once.")
+	flag.Var(annotations, "annotation", "An annotation of the form key=value that gets added to the CSIDriver object. Can be specified more than once.")
+}
+
 func main() {
 	flag.Set("logtostderr", "true")
 	flag.Parse()
@@ -71,68 +181,818 @@ func main() {
 	}
 	glog.Infof("Version: %s", version)
 
-	// Connect to CSI.
-	glog.V(1).Infof("Attempting to open a gRPC connection with: %q", *csiAddress)
-	csiConn, err := connection.NewConnection(*csiAddress, *connectionTimeout)
+	// Otherwise all registrars would use the same --startup-jitter
+	// delays and backoff jitter.
+	rand.Seed(time.Now().UnixNano())
+
+	if err := run(); err != nil {
+		if class := errorClassOf(err); class != "" {
+			glog.V(1).Infof("Failure class: %s", class)
+		}
+		fatalf("%v", err)
+	}
+}
+
+// run validates the flags, discovers the CSI drivers and keeps them
+// registered until terminated. Errors are classified as
+// startupError where possible.
+func run() error {
+	if err := validateFlags(); err != nil {
+		return err
+	}
+	glog.V(2).Infof("Resync period: %v", *resyncPeriod)
+	registerBackoff, _ = retryBackoff(*retrySteps, *retryBaseDuration, *retryFactor)
+
+	var fileConfig *Config
+	if *configFile != "" {
+		var err error
+		fileConfig, err = loadConfig(*configFile)
+		if err != nil {
+			return validationErrorf("--config: %v", err)
+		}
+	}
+	flagsSet := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) {
+		flagsSet[f.Name] = true
+	})
+	driverConfig := mergeConfig(fileConfig, &Config{
+		DriverName:            *driverNameOverride,
+		PodInfoOnMountVersion: *k8sPodInfoOnMountVersion,
+		Labels:                labels,
+		Annotations:           annotations,
+		ExtraSpec:             *extraSpecJSON,
+	}, flagsSet)
+	glog.V(1).Infof("Effective configuration: %+v", *driverConfig)
+	driverConfig.Annotations = mergeMap(driverConfig.Annotations, map[string]string{versionAnnotation: version})
+
+	addresses := []string(csiAddresses)
+	if len(addresses) == 0 {
+		addresses = []string{defaultCSIAddress}
+	}
+	// validateFlags already rejected --driver-name-override, but the
+	// name might also come from the configuration file.
+	if len(addresses) > 1 && fileConfig != nil && fileConfig.DriverName != "" {
+		return validationErrorf("--config: driverName cannot be used with more than one --csi-address")
+	}
+
+	ownerRef, err := ownerReference(*ownerRefAPIVersion, *ownerRefKind, *ownerRefName, *ownerRefUID)
 	if err != nil {
-		glog.Error(err.Error())
-		os.Exit(1)
+		return classify(validationFailure, err)
 	}
 
-	// Get connection context
-	ctx, cancel := context.WithTimeout(context.Background(), csiTimeout)
-	defer cancel()
+	creds, err := loadTLSCredentials(*csiTLSCert, *csiTLSKey, *csiTLSCA)
+	if err != nil {
+		return classify(validationFailure, err)
+	}
+	if creds != nil {
+		glog.V(1).Info("Using TLS for the connection to the CSI driver")
+	}
 
-	// Get CSI driver name.
-	glog.V(4).Infof("Calling CSI driver to discover driver name.")
-	csiDriverName, err := csiConn.GetDriverName(ctx)
+	// Connect to each CSI driver and discover its CSIDriver object.
+	var drivers []*driver
+	names := map[string]string{}
+	for _, address := range addresses {
+		d, err := discoverDriver(address, driverConfig, ownerRef, creds)
+		if err != nil {
+			return err
+		}
+		if other, ok := names[d.csiDriver.Name]; ok {
+			return validationErrorf("CSI drivers at %q and %q both have the name %q", other, address, d.csiDriver.Name)
+		}
+		names[d.csiDriver.Name] = address
+		readiness.expect(d.csiDriver.Name)
+		drivers = append(drivers, d)
+	}
+
+	if *selfTest {
+		for _, d := range drivers {
+			if err := writeSelfTestReport(os.Stdout, d.csiDriver, d.topology); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	if *printObject {
+		for _, d := range drivers {
+			if err := writeCSIDriverYAML(os.Stdout, d.csiDriver); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	if *dryRun {
+		for _, d := range drivers {
+			glog.Infof("Dry run, not modifying the cluster. CSIDriver object: %+v", *d.csiDriver)
+			verifyAndAddCSIDriverInfo(context.Background(), dryRunRegistrar{}, d.csiDriver, false, *respectExisting, *allowRecreate)
+		}
+		return nil
+	}
+
+	// Create the client config, see buildConfig for the precedence.
+	glog.V(1).Infof("Loading kubeconfig.")
+	config, err := buildConfig(*kubeconfig, *master, *tokenFile, *userAgent, float32(*kubeAPIQPS), *kubeAPIBurst)
+	if err != nil {
+		return classify(validationFailure, err)
+	}
+	if *kubeAPIProxyURL != "" {
+		if err := setProxy(config, *kubeAPIProxyURL); err != nil {
+			return validationErrorf("--kube-api-proxy-url: %v", err)
+		}
+		glog.V(1).Infof("Connecting to the Kubernetes API server through proxy %s", *kubeAPIProxyURL)
+	}
+	qps, burst := config.QPS, config.Burst
+	if qps == 0 {
+		qps = rest.DefaultQPS
+	}
+	if burst == 0 {
+		burst = rest.DefaultBurst
+	}
+	glog.V(1).Infof("Kubernetes API client QPS: %v, burst: %d", qps, burst)
+
+	if *minK8sVersion != "" {
+		discoveryClient, err := discovery.NewDiscoveryClientForConfig(config)
+		if err != nil {
+			return classify(validationFailure, err)
+		}
+		if err := checkServerVersion(discoveryClient, *minK8sVersion); err != nil {
+			return apiError(discoveryFailure, err)
+		}
+	}
+
+	var servers []*http.Server
+	if *metricsAddress != "" {
+		glog.V(1).Infof("Serving metrics on %s", *metricsAddress)
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", registry)
+		server, err := startHTTPServer(*metricsAddress, mux)
+		if err != nil {
+			return err
+		}
+		servers = append(servers, server)
+	}
+
+	if *debugAddress != "" {
+		glog.V(1).Infof("Serving pprof debug endpoints on %s", *debugAddress)
+		mux := http.NewServeMux()
+		mux.HandleFunc("/debug/pprof/", pprof.Index)
+		mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+		mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+		mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+		mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+		server, err := startHTTPServer(*debugAddress, mux)
+		if err != nil {
+			return err
+		}
+		servers = append(servers, server)
+	}
+
+	if *healthPort != 0 {
+		address := fmt.Sprintf(":%d", *healthPort)
+		glog.V(1).Infof("Serving health checks on %s", address)
+		var health healthCheckers
+		for _, d := range drivers {
+			health = append(health, d.health)
+		}
+		mux := http.NewServeMux()
+		mux.Handle("/healthz", health)
+		if *readinessPort == *healthPort {
+			glog.V(1).Infof("Serving readiness checks on %s", address)
+			mux.Handle("/readyz", readiness)
+		}
+		server, err := startHTTPServer(address, mux)
+		if err != nil {
+			return err
+		}
+		servers = append(servers, server)
+	}
+
+	if *readinessPort != 0 && *readinessPort != *healthPort {
+		address := fmt.Sprintf(":%d", *readinessPort)
+		glog.V(1).Infof("Serving readiness checks on %s", address)
+		mux := http.NewServeMux()
+		mux.Handle("/readyz", readiness)
+		server, err := startHTTPServer(address, mux)
+		if err != nil {
+			return err
+		}
+		servers = append(servers, server)
+	}
+
+	registrar, err := newRegistrar(config, *fieldManager)
+	if err != nil {
+		return apiError(connectionFailure, err)
+	}
+	if *waitForCRD > 0 {
+		discoveryClient, err := discovery.NewDiscoveryClientForConfig(config)
+		if err != nil {
+			return classify(validationFailure, err)
+		}
+		glog.V(1).Infof("Waiting up to %v for the API server to serve %s", *waitForCRD, k8scsi.CsiDriverResourcePlural)
+		if err := waitForResource(discoveryClient, k8scsi.SchemeGroupVersion.String(), k8scsi.CsiDriverResourcePlural, crdPollInterval, *waitForCRD); err != nil {
+			return classify(discoveryFailure, err)
+		}
+	}
+	if *objectTimeout > 0 {
+		registrar = &timeoutRegistrar{Registrar: registrar, timeout: *objectTimeout}
+	}
+	if *confirmRegistration {
+		registrar = &confirmingRegistrar{Registrar: registrar, interval: confirmInterval, timeout: confirmTimeout}
+	}
+	if *emitEvents {
+		namespace := *eventNamespaceFlag
+		if namespace == "" {
+			namespace, err = ownNamespace(*ownNamespaceFlag, *kubeconfig)
+			if err != nil {
+				return validationErrorf("--emit-events: %v", err)
+			}
+		}
+		recorder, err := newAPIEventRecorder(config, namespace)
+		if err != nil {
+			return err
+		}
+		registrar = &eventingRegistrar{Registrar: registrar, recorder: recorder}
+	}
+
+	var updaters nodeIDUpdaters
+	if *verifyNodeID {
+		updater, err := newAPINodeIDUpdater(config, *objectTimeout)
+		if err != nil {
+			return err
+		}
+		updaters = append(updaters, updater)
+	}
+	if *registerCSINodeInfo {
+		discoveryClient, err := discovery.NewDiscoveryClientForConfig(config)
+		if err != nil {
+			return classify(validationFailure, err)
+		}
+		available, err := csiNodeInfoAvailable(discoveryClient)
+		if err != nil {
+			return apiError(connectionFailure, err)
+		}
+		if available {
+			updater, err := newCSINodeInfoUpdater(config)
+			if err != nil {
+				return err
+			}
+			updaters = append(updaters, updater)
+		} else {
+			glog.Warningf("The API server does not serve %s.%s, not registering CSINodeInfo", k8scsi.CsiNodeInfoResourcePlural, k8scsi.GroupName)
+		}
+	}
+	if len(updaters) > 0 {
+		var updater nodeIDUpdater = updaters
+		if len(updaters) == 1 {
+			updater = updaters[0]
+		}
+		for _, d := range drivers {
+			d.nodeID = &nodeIDVerifier{
+				csiConn:    d.csiConn,
+				updater:    updater,
+				nodeName:   *nodeName,
+				driverName: d.name,
+			}
+		}
+	}
+
+	if *registerOnce {
+		var errs []error
+		for _, d := range drivers {
+			err := verifyAndAddCSIDriverInfo(context.Background(), registrar, d.csiDriver, false, *respectExisting, *allowRecreate)
+			if err == nil && d.nodeID != nil {
+				err = d.nodeID.verify(context.Background(), *csiTimeout)
+			}
+			if err != nil {
+				errs = append(errs, err)
+			}
+		}
+		shutdownHTTPServers(servers)
+		if err := utilerrors.NewAggregate(errs); err != nil {
+			return fmt.Errorf("Registration failed: %v", err)
+		}
+		glog.V(1).Info("Registered once, exiting")
+		return nil
+	}
+
+	// Stop registering on termination.
+	ctx, cancel := context.WithCancel(context.Background())
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, terminationSignals...)
+	go cancelOnSignal(c, cancel)
+
+	followRenames := *cleanupRenamed
+	if followRenames && driverConfig.DriverName != "" {
+		glog.Warning("--cleanup-renamed has no effect because the driver name is configured")
+		followRenames = false
+	}
+
+	// Run until terminated, then deregister all drivers. When
+	// terminated during the delay, registration is skipped and
+	// cleanup happens as usual.
+	if startupDelay(ctx, *startupJitter) {
+		var wg sync.WaitGroup
+		for _, d := range drivers {
+			wg.Add(1)
+			go func(d *driver) {
+				defer wg.Done()
+				kubernetesRegister(ctx, clock.RealClock{}, registrar, d.csiDriver, d.csiConn, d.nodeID, *csiTimeout, *resyncPeriod, *maxResyncBackoff, *respectExisting, *allowRecreate, *exitOnDelete, followRenames)
+			}(d)
+		}
+		wg.Wait()
+	} else {
+		glog.V(1).Info("Terminated during the startup delay, not registering")
+	}
+	return cleanup(func(ctx context.Context) error {
+		if *skipDeregistration {
+			glog.V(1).Info("Not removing CSIDriver objects because of --skip-deregistration")
+			return nil
+		}
+		var errs []error
+		for _, d := range drivers {
+			if err := verifyAndDeleteCSIDriverInfo(ctx, registrar, d.csiDriver, *deleteOnlyOwned); err != nil {
+				errs = append(errs, err)
+			}
+		}
+		return utilerrors.NewAggregate(errs)
+	}, servers, *shutdownTimeout)
+}
+
+// driver is one CSI driver served by the registrar.
+type driver struct {
+	// name is the name of the CSI driver, without the suffix of the
+	// CSIDriver object name.
+	name      string
+	csiConn   *driverConnection
+	csiDriver *k8scsi.CSIDriver
+	health    *healthChecker
+	nodeID    *nodeIDVerifier
+
+	// topology is true if the CSI driver has the
+	// VOLUME_ACCESSIBILITY_CONSTRAINTS capability.
+	topology bool
+}
+
+// discoverDriver connects to the CSI driver at the address and creates
+// the desired CSIDriver object for it. The configuration is not
+// modified.
+func discoverDriver(address string, driverConfig *Config, ownerRef *metav1.OwnerReference, creds credentials.TransportCredentials) (*driver, error) {
+	callMetrics := &csiCallMetrics{}
+	connectionOptions := []connection.Option{connection.WithCallObserver(callMetrics.observe)}
+	if creds != nil {
+		connectionOptions = append(connectionOptions, connection.WithTransportCredentials(creds))
+	}
+	connect := func(ctx context.Context) (connection.CSIConnection, string, error) {
+		return connectAndDiscover(ctx, address, *connectionRetryTimeout, connectionOptions...)
+	}
+	conn, csiDriverName, err := connect(context.Background())
 	if err != nil {
-		glog.Error(err.Error())
-		os.Exit(1)
+		return nil, classify(connectionFailure, err)
 	}
-	glog.V(2).Infof("CSI driver name: %q", csiDriverName)
+	callMetrics.setDriverName(csiDriverName)
+	csiConn := newDriverConnection(conn, csiDriverName, connect)
+	glog.V(2).Infof("CSI driver name at %q: %q", address, csiDriverName)
+	if driverConfig.DriverName == "" {
+		if err := validateDriverName(csiDriverName); err != nil {
+			csiConn.Close()
+			return nil, classify(discoveryFailure, fmt.Errorf("CSI driver reported an invalid name, use --driver-name-override to register it under a different name: %v", err))
+		}
+	}
+	health := &healthChecker{
+		csiConn:   csiConn,
+		staleness: *healthStaleness,
+		timeout:   *csiTimeout,
+	}
+	health.succeeded()
+
+	// Get connection context
+	csiCtx, csiCancel := context.WithTimeout(context.Background(), *csiTimeout)
+	defer csiCancel()
 
 	// Check if volume attach is required
 	glog.V(4).Infof("Checking if CSI driver implements ControllerPublishVolume().")
-	k8sAttachmentRequired, err := csiConn.IsAttachRequired(ctx)
+	k8sAttachmentRequired, err := csiConn.IsAttachRequired(csiCtx)
+	if err != nil {
+		csiConn.Close()
+		return nil, classify(discoveryFailure, err)
+	}
+
+	if *verboseCapabilities {
+		caps, err := csiConn.GetControllerCapabilities(csiCtx)
+		if err != nil {
+			glog.Warningf("Failed to get controller capabilities of CSI driver %s: %v", csiDriverName, err)
+		} else {
+			glog.Infof("Controller capabilities of CSI driver %s: %s", csiDriverName, capabilityNames(caps))
+		}
+	}
+
+	// Topology does not affect the CSIDriver object, it is only
+	// reported to help operators.
+	topology, err := csiConn.SupportsVolumeAccessibilityConstraints(csiCtx)
+	if err != nil {
+		glog.Warningf("Failed to get plugin capabilities of CSI driver %s: %v", csiDriverName, err)
+	} else if topology {
+		glog.Infof("CSI driver %s has the VOLUME_ACCESSIBILITY_CONSTRAINTS capability, its volumes may not be accessible from all nodes", csiDriverName)
+	}
+
+	config := *driverConfig
+	glog.V(4).Infof("Calling CSI driver to discover driver version.")
+	driverVersion, err := csiConn.GetDriverVersion(csiCtx)
+	if err != nil {
+		glog.Warningf("Failed to get CSI driver version, not recording it: %v", err)
+	} else {
+		glog.V(2).Infof("CSI driver version: %q", driverVersion)
+		config.Annotations = mergeMap(config.Annotations, map[string]string{driverVersionAnnotation: driverVersion})
+	}
+
+	driverName := csiDriverName
+	if config.DriverName != "" {
+		driverName = config.DriverName
+		glog.V(1).Infof("Registering driver as %q from the configuration instead of %q reported by the CSI driver", driverName, csiDriverName)
+	} else {
+		glog.V(1).Infof("Registering driver as %q reported by the CSI driver", driverName)
+	}
+
+	objectName := csiDriverObjectName(driverName)
+	if objectName != driverName {
+		if err := validateDriverName(objectName); err != nil {
+			csiConn.Close()
+			return nil, validationErrorf("--csidriver-resource-name-suffix: object name for driver %q: %v", driverName, err)
+		}
+		glog.V(1).Infof("Using CSIDriver object name %q for driver %q", objectName, driverName)
+	}
+
+	csiDriver := newCSIDriver(objectName, k8sAttachmentRequired, &config, ownerRef)
+	glog.V(2).Infof("CSIDriver object: %+v", *csiDriver)
+
+	return &driver{
+		name:      driverName,
+		csiConn:   csiConn,
+		csiDriver: csiDriver,
+		health:    health,
+		topology:  topology,
+	}, nil
+}
+
+// writeSelfTestReport prints what was discovered about a CSI driver
+// and the CSIDriver object for it as YAML.
+func writeSelfTestReport(w io.Writer, csiDriver *k8scsi.CSIDriver, topology bool) error {
+	data, err := csiDriverYAML(csiDriver)
+	if err != nil {
+		return err
+	}
+	driverVersion, ok := csiDriver.Annotations[driverVersionAnnotation]
+	if !ok {
+		driverVersion = "unknown"
+	}
+	attachRequired := csiDriver.Spec.AttachRequired != nil && *csiDriver.Spec.AttachRequired
+	_, err = fmt.Fprintf(w, "Driver name: %s\nDriver version: %s\nAttach required: %t\nVolume accessibility constraints: %t\nCSIDriver object:\n%s---\n",
+		csiDriver.Name, driverVersion, attachRequired, topology, data)
+	return err
+}
+
+// writeCSIDriverYAML prints the CSIDriver object as a YAML document.
+func writeCSIDriverYAML(w io.Writer, csiDriver *k8scsi.CSIDriver) error {
+	data, err := csiDriverYAML(csiDriver)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "---\n%s", data)
+	return err
+}
+
+// csiDriverYAML serializes the CSIDriver object including its type
+// meta data, so that it can be applied as it is.
+func csiDriverYAML(csiDriver *k8scsi.CSIDriver) ([]byte, error) {
+	obj := csiDriver.DeepCopy()
+	obj.APIVersion = k8scsi.SchemeGroupVersion.String()
+	obj.Kind = "CSIDriver"
+	return yaml.Marshal(obj)
+}
+
+// capabilityNames formats capabilities as a comma-separated list of
+// their names.
+func capabilityNames(caps []csi.ControllerServiceCapability_RPC_Type) string {
+	if len(caps) == 0 {
+		return "none"
+	}
+	var names []string
+	for _, cap := range caps {
+		names = append(names, cap.String())
+	}
+	return strings.Join(names, ", ")
+}
+
+// connectAndDiscover connects to the CSI driver and retrieves its name.
+// Failed attempts are retried with exponential backoff until the retry
+// timeout has passed or the context is cancelled.
+func connectAndDiscover(ctx context.Context, address string, retryTimeout time.Duration, opts ...connection.Option) (connection.CSIConnection, string, error) {
+	deadline := time.Now().Add(retryTimeout)
+	delay := initialRetryDelay
+	for attempt := 1; ; attempt++ {
+		csiConn, name, err := tryConnectAndDiscover(address, opts...)
+		if err == nil {
+			return csiConn, name, nil
+		}
+		if err == connection.ErrEmptyDriverName {
+			return nil, "", classify(discoveryFailure, fmt.Errorf("CSI driver at %q reported an empty name, it cannot be registered", address))
+		}
+		if time.Now().Add(delay).After(deadline) {
+			return nil, "", fmt.Errorf("failed to connect to CSI driver at %q after %d attempts: %v", address, attempt, err)
+		}
+		glog.V(2).Infof("Attempt %d to connect to CSI driver failed, retrying in %v: %v", attempt, delay, err)
+		select {
+		case <-ctx.Done():
+			return nil, "", fmt.Errorf("failed to connect to CSI driver at %q: %v", address, ctx.Err())
+		case <-time.After(delay):
+		}
+		delay *= 2
+		if delay > maxRetryDelay {
+			delay = maxRetryDelay
+		}
+	}
+}
+
+func tryConnectAndDiscover(address string, opts ...connection.Option) (connection.CSIConnection, string, error) {
+	glog.V(1).Infof("Attempting to open a gRPC connection with: %q", address)
+	if path := socketPath(address); path != "" {
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			return nil, "", fmt.Errorf("CSI driver socket %s does not exist, check that the driver is running and shares the socket directory with this container", path)
+		}
+	}
+	csiConn, err := connection.NewConnectionWithKeepalive(address, *connectionTimeout, *keepaliveTime, *keepaliveTimeout, opts...)
 	if err != nil {
-		glog.Error(err.Error())
-		os.Exit(1)
+		return nil, "", err
+	}
+
+	if err := waitForDriverReady(csiConn, *probeTimeout); err != nil {
+		csiConn.Close()
+		return nil, "", err
+	}
+
+	// Get connection context
+	ctx, cancel := context.WithTimeout(context.Background(), *csiTimeout)
+	defer cancel()
+
+	glog.V(4).Infof("Calling CSI driver to discover driver name.")
+	name, err := discoverDriverName(ctx, csiConn, *driverNameManifestKey)
+	if err != nil {
+		csiConn.Close()
+		return nil, "", err
+	}
+	return csiConn, name, nil
+}
+
+// discoverDriverName returns the value for manifestKey from the
+// manifest of the driver, if set, and otherwise the name reported by
+// the driver.
+func discoverDriverName(ctx context.Context, csiConn connection.CSIConnection, manifestKey string) (string, error) {
+	if manifestKey != "" {
+		manifest, err := csiConn.GetDriverManifest(ctx)
+		if err != nil {
+			return "", err
+		}
+		if name := manifest[manifestKey]; name != "" {
+			glog.V(1).Infof("Using driver name %q from manifest entry %q", name, manifestKey)
+			return name, nil
+		}
+		glog.V(1).Infof("CSI driver has no manifest entry %q, using the name it reports", manifestKey)
+	}
+	return csiConn.GetDriverName(ctx)
+}
+
+// waitForDriverReady calls Probe until the driver reports that it is
+// ready or the timeout has passed.
+func waitForDriverReady(csiConn connection.CSIConnection, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), *csiTimeout)
+		ready, err := csiConn.Probe(ctx)
+		cancel()
+		if err == nil && ready {
+			glog.V(2).Infof("CSI driver is ready")
+			return nil
+		}
+		if time.Now().Add(probeInterval).After(deadline) {
+			if err != nil {
+				return fmt.Errorf("CSI driver did not become ready within %v: %v", timeout, err)
+			}
+			return fmt.Errorf("CSI driver did not become ready within %v", timeout)
+		}
+		if err != nil {
+			glog.V(4).Infof("Probe failed, retrying: %v", err)
+		} else {
+			glog.V(4).Infof("CSI driver is not ready yet, retrying")
+		}
+		time.Sleep(probeInterval)
 	}
+}
+
+// validateDriverName checks that the name can be used for a CSIDriver
+// object.
+func validateDriverName(name string) error {
+	if errs := validation.IsDNS1123Subdomain(name); len(errs) > 0 {
+		return fmt.Errorf("driver name %q is not a valid DNS-1123 subdomain: %s", name, strings.Join(errs, ", "))
+	}
+	return nil
+}
+
+// csiDriverObjectName returns the name of the CSIDriver object for the
+// driver, including the suffix from --csidriver-resource-name-suffix.
+func csiDriverObjectName(driverName string) string {
+	return driverName + *objectNameSuffix
+}
 
-	// Create CSIDriver object
+// newCSIDriver creates the desired CSIDriver object.
+func newCSIDriver(name string, attachRequired bool, config *Config, ownerRef *metav1.OwnerReference) *k8scsi.CSIDriver {
+	podInfoOnMountVersion := config.PodInfoOnMountVersion
+	// The config is shared by all drivers, so each object gets its
+	// own copy of the maps.
 	csiDriver := &k8scsi.CSIDriver{
 		ObjectMeta: metav1.ObjectMeta{
-			Name: csiDriverName,
+			Name:        name,
+			Labels:      mergeMap(nil, config.Labels),
+			Annotations: mergeMap(nil, config.Annotations),
 		},
 		Spec: k8scsi.CSIDriverSpec{
-			AttachRequired:        &k8sAttachmentRequired,
-			PodInfoOnMountVersion: k8sPodInfoOnMountVersion,
+			AttachRequired:        &attachRequired,
+			PodInfoOnMountVersion: &podInfoOnMountVersion,
 		},
 	}
+	if config.ExtraSpec != "" {
+		// Already checked by validateFlags.
+		applyExtraSpec(&csiDriver.Spec, config.ExtraSpec, false)
+	}
+	if ownerRef != nil {
+		csiDriver.OwnerReferences = []metav1.OwnerReference{*ownerRef}
+	}
+	return csiDriver
+}
 
-	glog.V(2).Infof("CSIDriver object: %+v", *csiDriver)
+// socketPath returns the path of the unix domain socket for addresses
+// that are absolute paths or unix:// URLs and an empty string for
+// everything else.
+func socketPath(address string) string {
+	path := strings.TrimPrefix(address, "unix://")
+	if strings.HasPrefix(path, "/") {
+		return path
+	}
+	return ""
+}
 
-	// Create the client config. Use kubeconfig if given, otherwise assume
-	// in-cluster.
-	glog.V(1).Infof("Loading kubeconfig.")
-	config, err := buildConfig(*kubeconfig)
-	if err != nil {
-		glog.Error(err.Error())
-		os.Exit(1)
+// validateCSIAddress checks that the address is either a unix domain
+// socket or a host:port TCP address. A socket that does not exist yet
+// is accepted because the driver might still be starting.
+func validateCSIAddress(address string) error {
+	if path := socketPath(address); path != "" {
+		info, err := os.Stat(path)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("--csi-address: %v", err)
+		}
+		if info.Mode()&os.ModeSocket == 0 {
+			return fmt.Errorf("--csi-address: %s is not a unix domain socket", path)
+		}
+		return nil
+	}
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		return fmt.Errorf("--csi-address: %q is neither the absolute path of a unix domain socket nor a host:port TCP address: %v", address, err)
+	}
+	return nil
+}
+
+// ownerReference builds the owner reference for the CSIDriver object
+// from the --owner-ref flags. It returns nil if none of them are set.
+func ownerReference(apiVersion, kind, name, uid string) (*metav1.OwnerReference, error) {
+	if apiVersion == "" && kind == "" && name == "" && uid == "" {
+		return nil, nil
+	}
+	if apiVersion == "" || kind == "" || name == "" || uid == "" {
+		return nil, fmt.Errorf("--owner-ref-api-version, --owner-ref-kind, --owner-ref-name and --owner-ref-uid must be set together")
+	}
+	if _, err := schema.ParseGroupVersion(apiVersion); err != nil {
+		return nil, fmt.Errorf("invalid --owner-ref-api-version: %v", err)
+	}
+	if errs := validation.IsCIdentifier(kind); len(errs) > 0 {
+		return nil, fmt.Errorf("invalid --owner-ref-kind %q: %s", kind, strings.Join(errs, ", "))
+	}
+	if errs := validation.IsDNS1123Subdomain(name); len(errs) > 0 {
+		return nil, fmt.Errorf("invalid --owner-ref-name %q: %s", name, strings.Join(errs, ", "))
+	}
+	return &metav1.OwnerReference{
+		APIVersion: apiVersion,
+		Kind:       kind,
+		Name:       name,
+		UID:        types.UID(uid),
+	}, nil
+}
+
+// buildConfig loads the client configuration with the same precedence
+// as kubectl: the kubeconfig file given with --kubeconfig, the files in
+// the KUBECONFIG environment variable, ~/.kube/config and finally the
+// service account that Kubernetes gives to pods. An API server URL
+// given with --master replaces all of them. Without a userAgent, the
+// component name and version are used.
+func buildConfig(kubeconfig, master, tokenFile, userAgent string, qps float32, burst int) (*rest.Config, error) {
+	var config *rest.Config
+	if master != "" {
+		if kubeconfig != "" {
+			return nil, fmt.Errorf("--master and --kubeconfig cannot be used together")
+		}
+		var err error
+		config, err = masterConfig(master, tokenFile)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		if tokenFile != "" {
+			return nil, fmt.Errorf("--token-file requires --master")
+		}
+		loadingRules := clientcmd.NewDefaultClientConfigLoadingRules()
+		loadingRules.ExplicitPath = kubeconfig
+		var err error
+		config, err = clientcmd.NewNonInteractiveDeferredLoadingClientConfig(loadingRules, &clientcmd.ConfigOverrides{}).ClientConfig()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if userAgent == "" {
+		userAgent = componentName + "/" + version
 	}
+	config.UserAgent = userAgent
 
-	// Run forever
-	kubernetesRegister(config, csiDriver)
+	// Zero values keep the client-go defaults.
+	if qps > 0 {
+		config.QPS = qps
+	}
+	if burst > 0 {
+		config.Burst = burst
+	}
+	return config, nil
 }
 
-func buildConfig(kubeconfig string) (*rest.Config, error) {
-	if kubeconfig != "" {
-		return clientcmd.BuildConfigFromFlags("", kubeconfig)
+// masterConfig creates a client configuration for the API server at
+// the given URL which authenticates with the bearer token from
+// tokenFile, if set.
+func masterConfig(master, tokenFile string) (*rest.Config, error) {
+	u, err := url.Parse(master)
+	if err != nil {
+		return nil, fmt.Errorf("--master: invalid URL %q: %v", master, err)
+	}
+	if u.Scheme == "" || u.Host == "" {
+		return nil, fmt.Errorf("--master: invalid URL %q: must include scheme and host", master)
+	}
+	config := &rest.Config{Host: master}
+	if tokenFile != "" {
+		token, err := ioutil.ReadFile(tokenFile)
+		if err != nil {
+			return nil, fmt.Errorf("--token-file: %v", err)
+		}
+		config.BearerToken = strings.TrimSpace(string(token))
+		if config.BearerToken == "" {
+			return nil, fmt.Errorf("--token-file: %s is empty", tokenFile)
+		}
 	}
+	return config, nil
+}
 
-	// Return config object which uses the service account kubernetes gives to
-	// pods. It's intended for clients that are running inside a pod running on
-	// kubernetes.
-	return rest.InClusterConfig()
+// setProxy makes the client use the given proxy for all requests to the
+// API server. Without it, client-go uses the proxy from the
+// HTTP_PROXY, HTTPS_PROXY and NO_PROXY environment variables. An
+// existing WrapTransport, like the one for in-cluster authentication,
+// is kept.
+func setProxy(config *rest.Config, proxyURL string) error {
+	u, err := url.Parse(proxyURL)
+	if err != nil {
+		return fmt.Errorf("invalid proxy URL %q: %v", proxyURL, err)
+	}
+	if u.Scheme == "" || u.Host == "" {
+		return fmt.Errorf("invalid proxy URL %q: must include scheme and host", proxyURL)
+	}
+	wrap := config.WrapTransport
+	config.WrapTransport = func(rt http.RoundTripper) http.RoundTripper {
+		if t, ok := rt.(*http.Transport); ok {
+			// The transport is shared, so use a new one with
+			// the same settings as in client-go's transport
+			// cache instead of modifying it.
+			rt = utilnet.SetTransportDefaults(&http.Transport{
+				Proxy:               http.ProxyURL(u),
+				TLSHandshakeTimeout: t.TLSHandshakeTimeout,
+				TLSClientConfig:     t.TLSClientConfig,
+				MaxIdleConnsPerHost: t.MaxIdleConnsPerHost,
+				DialContext:         t.DialContext,
+			})
+		} else {
+			glog.Warningf("Cannot set proxy for Kubernetes API client transport of type %T", rt)
+		}
+		if wrap != nil {
+			rt = wrap(rt)
+		}
+		return rt
+	}
+	return nil
 }
@@ -0,0 +1,675 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/rest"
+	k8scsi "k8s.io/csi-api/pkg/apis/csi/v1alpha1"
+)
+
+func TestValidateDriverName(t *testing.T) {
+	tests := []struct {
+		name        string
+		driverName  string
+		expectError bool
+	}{
+		{
+			name:       "valid",
+			driverName: "hostpath.csi.k8s.io",
+		},
+		{
+			name:        "uppercase",
+			driverName:  "HostPath.csi.k8s.io",
+			expectError: true,
+		},
+		{
+			name:        "slash",
+			driverName:  "csi/example",
+			expectError: true,
+		},
+		{
+			name:        "empty",
+			driverName:  "",
+			expectError: true,
+		},
+	}
+
+	for _, test := range tests {
+		err := validateDriverName(test.driverName)
+		if test.expectError && err == nil {
+			t.Errorf("test %q: Expected error, got none", test.name)
+		}
+		if !test.expectError && err != nil {
+			t.Errorf("test %q: got error: %v", test.name, err)
+		}
+	}
+}
+
+func TestOwnerReference(t *testing.T) {
+	tests := []struct {
+		name        string
+		apiVersion  string
+		kind        string
+		ownerName   string
+		uid         string
+		expectRef   bool
+		expectError bool
+	}{
+		{
+			name: "unset",
+		},
+		{
+			name:       "valid",
+			apiVersion: "apps/v1",
+			kind:       "DaemonSet",
+			ownerName:  "csi-hostpath",
+			uid:        "c4a1f3a8-0b5a-11e9-ab14-d663bd873d93",
+			expectRef:  true,
+		},
+		{
+			name:        "missing UID",
+			apiVersion:  "apps/v1",
+			kind:        "DaemonSet",
+			ownerName:   "csi-hostpath",
+			expectError: true,
+		},
+		{
+			name:        "invalid kind",
+			apiVersion:  "apps/v1",
+			kind:        "Daemon-Set",
+			ownerName:   "csi-hostpath",
+			uid:         "c4a1f3a8-0b5a-11e9-ab14-d663bd873d93",
+			expectError: true,
+		},
+		{
+			name:        "invalid name",
+			apiVersion:  "apps/v1",
+			kind:        "DaemonSet",
+			ownerName:   "CSI_hostpath",
+			uid:         "c4a1f3a8-0b5a-11e9-ab14-d663bd873d93",
+			expectError: true,
+		},
+		{
+			name:        "invalid API version",
+			apiVersion:  "apps/v1/beta",
+			kind:        "DaemonSet",
+			ownerName:   "csi-hostpath",
+			uid:         "c4a1f3a8-0b5a-11e9-ab14-d663bd873d93",
+			expectError: true,
+		},
+	}
+
+	for _, test := range tests {
+		ref, err := ownerReference(test.apiVersion, test.kind, test.ownerName, test.uid)
+		if test.expectError && err == nil {
+			t.Errorf("test %q: Expected error, got none", test.name)
+		}
+		if !test.expectError && err != nil {
+			t.Errorf("test %q: got error: %v", test.name, err)
+		}
+		if test.expectRef != (ref != nil) {
+			t.Errorf("test %q: expected owner reference %t, got %+v", test.name, test.expectRef, ref)
+		}
+	}
+}
+
+func TestBuildConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cluster-driver-registrar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	writeKubeconfig := func(name, server string) string {
+		path := filepath.Join(dir, name)
+		content := fmt.Sprintf(`apiVersion: v1
+kind: Config
+clusters:
+- name: test
+  cluster:
+    server: %s
+contexts:
+- name: test
+  context:
+    cluster: test
+current-context: test
+`, server)
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	flagPath := writeKubeconfig("flag", "https://flag.example.com")
+	envPath := writeKubeconfig("env", "https://env.example.com")
+
+	tests := []struct {
+		name           string
+		kubeconfig     string
+		env            string
+		expectedServer string
+	}{
+		{
+			name:           "flag",
+			kubeconfig:     flagPath,
+			expectedServer: "https://flag.example.com",
+		},
+		{
+			name:           "env",
+			env:            envPath,
+			expectedServer: "https://env.example.com",
+		},
+		{
+			name:           "flag before env",
+			kubeconfig:     flagPath,
+			env:            envPath,
+			expectedServer: "https://flag.example.com",
+		},
+	}
+
+	defer os.Setenv("KUBECONFIG", os.Getenv("KUBECONFIG"))
+	for _, test := range tests {
+		os.Setenv("KUBECONFIG", test.env)
+		config, err := buildConfig(test.kubeconfig, "", "", "", 0, 0)
+		if err != nil {
+			t.Errorf("test %q: got error: %v", test.name, err)
+			continue
+		}
+		if config.Host != test.expectedServer {
+			t.Errorf("test %q: expected server %q, got %q", test.name, test.expectedServer, config.Host)
+		}
+	}
+}
+
+func TestBuildConfigMaster(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cluster-driver-registrar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tokenFile := filepath.Join(dir, "token")
+	if err := ioutil.WriteFile(tokenFile, []byte("secret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	emptyFile := filepath.Join(dir, "empty")
+	if err := ioutil.WriteFile(emptyFile, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name          string
+		kubeconfig    string
+		master        string
+		tokenFile     string
+		expectError   bool
+		expectedToken string
+	}{
+		{
+			name:   "without token",
+			master: "https://master.example.com",
+		},
+		{
+			name:          "with token",
+			master:        "https://master.example.com",
+			tokenFile:     tokenFile,
+			expectedToken: "secret",
+		},
+		{
+			name:        "no scheme",
+			master:      "master.example.com",
+			expectError: true,
+		},
+		{
+			name:        "missing token file",
+			master:      "https://master.example.com",
+			tokenFile:   filepath.Join(dir, "no-such-file"),
+			expectError: true,
+		},
+		{
+			name:        "empty token file",
+			master:      "https://master.example.com",
+			tokenFile:   emptyFile,
+			expectError: true,
+		},
+		{
+			name:        "token without master",
+			tokenFile:   tokenFile,
+			expectError: true,
+		},
+		{
+			name:        "master and kubeconfig",
+			kubeconfig:  filepath.Join(dir, "kubeconfig"),
+			master:      "https://master.example.com",
+			expectError: true,
+		},
+	}
+
+	for _, test := range tests {
+		config, err := buildConfig(test.kubeconfig, test.master, test.tokenFile, "", 0, 0)
+		if test.expectError {
+			if err == nil {
+				t.Errorf("test %q: Expected error, got none", test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("test %q: got error: %v", test.name, err)
+			continue
+		}
+		if config.Host != test.master {
+			t.Errorf("test %q: expected server %q, got %q", test.name, test.master, config.Host)
+		}
+		if config.BearerToken != test.expectedToken {
+			t.Errorf("test %q: expected token %q, got %q", test.name, test.expectedToken, config.BearerToken)
+		}
+	}
+}
+
+func TestBuildConfigUserAgent(t *testing.T) {
+	tests := []struct {
+		name      string
+		userAgent string
+		expected  string
+	}{
+		{
+			name:     "default",
+			expected: componentName + "/" + version,
+		},
+		{
+			name:      "custom",
+			userAgent: "my-registrar/1.0",
+			expected:  "my-registrar/1.0",
+		},
+	}
+
+	for _, test := range tests {
+		var userAgent string
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			userAgent = r.Header.Get("User-Agent")
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"gitVersion": "v1.12.0"}`))
+		}))
+		config, err := buildConfig("", server.URL, "", test.userAgent, 0, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		client, err := discovery.NewDiscoveryClientForConfig(config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = client.ServerVersion()
+		server.Close()
+		if err != nil {
+			t.Errorf("test %q: request failed: %v", test.name, err)
+			continue
+		}
+		if userAgent != test.expected {
+			t.Errorf("test %q: expected user agent %q, got %q", test.name, test.expected, userAgent)
+		}
+	}
+}
+
+func TestValidateCSIAddress(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cluster-driver-registrar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	socket := filepath.Join(dir, "csi.sock")
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	file := filepath.Join(dir, "file")
+	if err := ioutil.WriteFile(file, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name        string
+		address     string
+		expectError bool
+	}{
+		{
+			name:    "socket",
+			address: socket,
+		},
+		{
+			name:    "socket URL",
+			address: "unix://" + socket,
+		},
+		{
+			name:    "missing socket",
+			address: filepath.Join(dir, "missing.sock"),
+		},
+		{
+			name:        "regular file",
+			address:     file,
+			expectError: true,
+		},
+		{
+			name:    "TCP",
+			address: "localhost:10000",
+		},
+		{
+			name:        "relative path",
+			address:     "csi.sock",
+			expectError: true,
+		},
+	}
+
+	for _, test := range tests {
+		err := validateCSIAddress(test.address)
+		if test.expectError && err == nil {
+			t.Errorf("test %q: Expected error, got none", test.name)
+		}
+		if !test.expectError && err != nil {
+			t.Errorf("test %q: got error: %v", test.name, err)
+		}
+	}
+}
+
+func TestNewCSIDriver(t *testing.T) {
+	ownerRef := &metav1.OwnerReference{APIVersion: "apps/v1", Kind: "Deployment", Name: "csi-driver", UID: "1234"}
+	tests := []struct {
+		name     string
+		config   Config
+		ownerRef *metav1.OwnerReference
+	}{
+		{
+			name: "defaults",
+		},
+		{
+			name: "pod info",
+			config: Config{
+				PodInfoOnMountVersion: "v1",
+			},
+		},
+		{
+			name: "metadata",
+			config: Config{
+				Labels:      map[string]string{"team": "storage"},
+				Annotations: map[string]string{"example.com/owner": "storage"},
+			},
+			ownerRef: ownerRef,
+		},
+	}
+
+	for _, test := range tests {
+		config := test.config
+		csiDriver := newCSIDriver("csi.example.com", true, &config, test.ownerRef)
+		if csiDriver.Name != "csi.example.com" {
+			t.Errorf("test %q: expected name csi.example.com, got %s", test.name, csiDriver.Name)
+		}
+		if csiDriver.Spec.AttachRequired == nil || !*csiDriver.Spec.AttachRequired {
+			t.Errorf("test %q: expected attach required", test.name)
+		}
+		if csiDriver.Spec.PodInfoOnMountVersion == nil || *csiDriver.Spec.PodInfoOnMountVersion != test.config.PodInfoOnMountVersion {
+			t.Errorf("test %q: expected pod info version %q, got %v", test.name, test.config.PodInfoOnMountVersion, csiDriver.Spec.PodInfoOnMountVersion)
+		}
+		if !reflect.DeepEqual(csiDriver.Labels, test.config.Labels) || !reflect.DeepEqual(csiDriver.Annotations, test.config.Annotations) {
+			t.Errorf("test %q: expected labels %v and annotations %v, got %v and %v", test.name,
+				test.config.Labels, test.config.Annotations, csiDriver.Labels, csiDriver.Annotations)
+		}
+		if (test.ownerRef == nil) != (len(csiDriver.OwnerReferences) == 0) {
+			t.Errorf("test %q: unexpected owner references %v", test.name, csiDriver.OwnerReferences)
+		}
+
+		// The object must not share the pod info version with the
+		// config.
+		config.PodInfoOnMountVersion = "changed"
+		if *csiDriver.Spec.PodInfoOnMountVersion == "changed" {
+			t.Errorf("test %q: object shares pod info version with config", test.name)
+		}
+		// Nor the labels and annotations.
+		if len(csiDriver.Labels) > 0 {
+			csiDriver.Labels["changed"] = "true"
+			if _, ok := test.config.Labels["changed"]; ok {
+				t.Errorf("test %q: object shares labels with config", test.name)
+			}
+		}
+		if len(csiDriver.Annotations) > 0 {
+			csiDriver.Annotations["changed"] = "true"
+			if _, ok := test.config.Annotations["changed"]; ok {
+				t.Errorf("test %q: object shares annotations with config", test.name)
+			}
+		}
+	}
+}
+
+func TestDiscoverDriverName(t *testing.T) {
+	tests := []struct {
+		name         string
+		conn         *fakeCSIConnection
+		manifestKey  string
+		expectError  bool
+		expectedName string
+	}{
+		{
+			name:         "reported name",
+			conn:         &fakeCSIConnection{name: "csi-example", manifest: map[string]string{"kubernetes-name": "csi.example.com"}},
+			expectedName: "csi-example",
+		},
+		{
+			name:         "manifest",
+			conn:         &fakeCSIConnection{name: "csi-example", manifest: map[string]string{"kubernetes-name": "csi.example.com"}},
+			manifestKey:  "kubernetes-name",
+			expectedName: "csi.example.com",
+		},
+		{
+			name:         "no manifest entry",
+			conn:         &fakeCSIConnection{name: "csi-example", manifest: map[string]string{"other": "x"}},
+			manifestKey:  "kubernetes-name",
+			expectedName: "csi-example",
+		},
+		{
+			name:        "error",
+			conn:        &fakeCSIConnection{err: fmt.Errorf("mock error")},
+			manifestKey: "kubernetes-name",
+			expectError: true,
+		},
+	}
+
+	for _, test := range tests {
+		name, err := discoverDriverName(context.Background(), test.conn, test.manifestKey)
+		if test.expectError && err == nil {
+			t.Errorf("test %q: Expected error, got none", test.name)
+		}
+		if !test.expectError && err != nil {
+			t.Errorf("test %q: got error: %v", test.name, err)
+		}
+		if name != test.expectedName {
+			t.Errorf("test %q: expected name %q, got %q", test.name, test.expectedName, name)
+		}
+	}
+}
+
+func TestWriteSelfTestReport(t *testing.T) {
+	tests := []struct {
+		name      string
+		csiDriver *k8scsi.CSIDriver
+		topology  bool
+		expected  string
+	}{
+		{
+			name:      "with version",
+			csiDriver: withAnnotations(makeCSIDriver("csi.example.com", true, nil), map[string]string{driverVersionAnnotation: "1.0.0"}),
+			topology:  true,
+			expected: `Driver name: csi.example.com
+Driver version: 1.0.0
+Attach required: true
+Volume accessibility constraints: true
+CSIDriver object:
+apiVersion: csi.storage.k8s.io/v1alpha1
+kind: CSIDriver
+metadata:
+  annotations:
+    csi.storage.k8s.io/driver-version: 1.0.0
+  creationTimestamp: null
+  name: csi.example.com
+spec:
+  attachRequired: true
+  podInfoOnMountVersion: ""
+---
+`,
+		},
+		{
+			name:      "without version",
+			csiDriver: makeCSIDriver("csi.example.com", false, nil),
+			expected: `Driver name: csi.example.com
+Driver version: unknown
+Attach required: false
+Volume accessibility constraints: false
+CSIDriver object:
+apiVersion: csi.storage.k8s.io/v1alpha1
+kind: CSIDriver
+metadata:
+  creationTimestamp: null
+  name: csi.example.com
+spec:
+  attachRequired: false
+  podInfoOnMountVersion: ""
+---
+`,
+		},
+	}
+
+	for _, test := range tests {
+		var out bytes.Buffer
+		if err := writeSelfTestReport(&out, test.csiDriver, test.topology); err != nil {
+			t.Errorf("test %q: got error: %v", test.name, err)
+			continue
+		}
+		if out.String() != test.expected {
+			t.Errorf("test %q: expected output:\n%s\ngot:\n%s", test.name, test.expected, out.String())
+		}
+	}
+}
+
+func TestWriteCSIDriverYAML(t *testing.T) {
+	var out bytes.Buffer
+	for _, name := range []string{"a.example.com", "b.example.com"} {
+		csiDriver := withAnnotations(makeCSIDriver(name, true, nil), map[string]string{driverVersionAnnotation: "1.0.0"})
+		if err := writeCSIDriverYAML(&out, csiDriver); err != nil {
+			t.Fatalf("got error: %v", err)
+		}
+	}
+	expected := `---
+apiVersion: csi.storage.k8s.io/v1alpha1
+kind: CSIDriver
+metadata:
+  annotations:
+    csi.storage.k8s.io/driver-version: 1.0.0
+  creationTimestamp: null
+  name: a.example.com
+spec:
+  attachRequired: true
+  podInfoOnMountVersion: ""
+---
+apiVersion: csi.storage.k8s.io/v1alpha1
+kind: CSIDriver
+metadata:
+  annotations:
+    csi.storage.k8s.io/driver-version: 1.0.0
+  creationTimestamp: null
+  name: b.example.com
+spec:
+  attachRequired: true
+  podInfoOnMountVersion: ""
+`
+	if out.String() != expected {
+		t.Errorf("expected output:\n%s\ngot:\n%s", expected, out.String())
+	}
+}
+
+func TestCapabilityNames(t *testing.T) {
+	if names := capabilityNames(nil); names != "none" {
+		t.Errorf("expected none, got %q", names)
+	}
+	names := capabilityNames([]csi.ControllerServiceCapability_RPC_Type{
+		csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME,
+		csi.ControllerServiceCapability_RPC_PUBLISH_UNPUBLISH_VOLUME,
+	})
+	if names != "CREATE_DELETE_VOLUME, PUBLISH_UNPUBLISH_VOLUME" {
+		t.Errorf("unexpected names %q", names)
+	}
+}
+
+func TestSetProxy(t *testing.T) {
+	// The proxy answers the version request itself. The API server
+	// host does not exist, so the request only succeeds through the
+	// proxy.
+	var proxied string
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxied = r.URL.Host + r.URL.Path
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"major": "1", "minor": "12", "gitVersion": "v1.12.0"}`))
+	}))
+	defer proxy.Close()
+
+	wrapped := false
+	config := &rest.Config{
+		Host: "http://apiserver.invalid",
+		WrapTransport: func(rt http.RoundTripper) http.RoundTripper {
+			wrapped = true
+			return rt
+		},
+	}
+	if err := setProxy(config, proxy.URL); err != nil {
+		t.Fatal(err)
+	}
+	client, err := discovery.NewDiscoveryClientForConfig(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := client.ServerVersion()
+	if err != nil {
+		t.Fatalf("request through proxy failed: %v", err)
+	}
+	if info.GitVersion != "v1.12.0" {
+		t.Errorf("unexpected version %q", info.GitVersion)
+	}
+	if proxied != "apiserver.invalid/version" {
+		t.Errorf("unexpected proxied URL %q", proxied)
+	}
+	if !wrapped {
+		t.Error("original WrapTransport was not called")
+	}
+
+	for _, invalid := range []string{"proxy:3128", "://proxy", "http://"} {
+		if err := setProxy(&rest.Config{}, invalid); err == nil {
+			t.Errorf("%q: Expected error, got none", invalid)
+		}
+	}
+}
@@ -0,0 +1,84 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/status"
+
+	"github.com/kubernetes-csi/cluster-driver-registrar/pkg/metrics"
+)
+
+const metricsPrefix = "csi_cluster_driver_registrar_"
+
+// unknownDriverName is used as driver_name label value for calls made
+// before the name was discovered.
+const unknownDriverName = "unknown-driver"
+
+var (
+	registry = metrics.NewRegistry()
+
+	registeredGauge = registry.NewGaugeVec(metricsPrefix+"registered",
+		"Whether the CSIDriver object is currently registered (1) or not (0).",
+		"driver_name")
+	addErrorsTotal = registry.NewCounterVec(metricsPrefix+"add_errors_total",
+		"Number of failed attempts to create or update the CSIDriver object.",
+		"driver_name")
+	removeErrorsTotal = registry.NewCounterVec(metricsPrefix+"remove_errors_total",
+		"Number of failed attempts to delete the CSIDriver object.",
+		"driver_name")
+	apiVersionUsed = registry.NewCounterVec(metricsPrefix+"api_version_used",
+		"Number of times a registrar was created for the CSIDriver API with the given version.",
+		"version")
+	reconcileDurationSeconds = registry.NewHistogramVec(metricsPrefix+"reconcile_duration_seconds",
+		"Duration of checking and updating the CSIDriver object and the node ID, including the API calls, in seconds.",
+		[]float64{0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60},
+		"outcome")
+
+	// Same name and labels as in the other CSI sidecars.
+	csiOperationsSeconds = registry.NewHistogramVec("csi_sidecar_operations_seconds",
+		"Duration of gRPC calls to the CSI driver, in seconds.",
+		[]float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 15, 25, 50, 120, 300, 600},
+		"driver_name", "method_name", "grpc_status_code")
+)
+
+// csiCallMetrics records gRPC calls to the CSI driver in
+// csiOperationsSeconds.
+type csiCallMetrics struct {
+	mutex      sync.Mutex
+	driverName string
+}
+
+// setDriverName sets the driver_name label for all following calls.
+func (m *csiCallMetrics) setDriverName(name string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.driverName = name
+}
+
+// observe implements connection.CallObserver.
+func (m *csiCallMetrics) observe(method string, duration time.Duration, err error) {
+	m.mutex.Lock()
+	driverName := m.driverName
+	m.mutex.Unlock()
+	if driverName == "" {
+		driverName = unknownDriverName
+	}
+	csiOperationsSeconds.Observe(duration.Seconds(), driverName, method, status.Code(err).String())
+}
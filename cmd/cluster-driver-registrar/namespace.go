@@ -0,0 +1,56 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/golang/glog"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+// File with the namespace of the pod, provided by Kubernetes for the
+// service account.
+var serviceAccountNamespaceFile = "/var/run/secrets/kubernetes.io/serviceaccount/namespace"
+
+// ownNamespace returns the namespace of the registrar: the one given
+// with --namespace, otherwise the namespace of its own pod. Outside of
+// a cluster, the namespace of the current context in the kubeconfig
+// file is used instead. It returns an error if none of these are
+// available.
+func ownNamespace(namespace, kubeconfig string) (string, error) {
+	if namespace != "" {
+		return namespace, nil
+	}
+	data, err := ioutil.ReadFile(serviceAccountNamespaceFile)
+	if err == nil {
+		if namespace := strings.TrimSpace(string(data)); namespace != "" {
+			glog.V(2).Infof("Using namespace %s of the service account", namespace)
+			return namespace, nil
+		}
+	}
+	loadingRules := clientcmd.NewDefaultClientConfigLoadingRules()
+	loadingRules.ExplicitPath = kubeconfig
+	namespace, _, err = clientcmd.NewNonInteractiveDeferredLoadingClientConfig(loadingRules, &clientcmd.ConfigOverrides{}).Namespace()
+	if err != nil {
+		return "", fmt.Errorf("cannot determine own namespace, neither %s nor a kubeconfig context are available, use --namespace: %v", serviceAccountNamespaceFile, err)
+	}
+	glog.V(2).Infof("Using namespace %s of the kubeconfig context", namespace)
+	return namespace, nil
+}
@@ -0,0 +1,109 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestOwnNamespace(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cluster-driver-registrar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	namespaceFile := filepath.Join(dir, "namespace")
+	if err := ioutil.WriteFile(namespaceFile, []byte("kube-system\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	emptyFile := filepath.Join(dir, "empty")
+	if err := ioutil.WriteFile(emptyFile, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	kubeconfig := filepath.Join(dir, "kubeconfig")
+	if err := ioutil.WriteFile(kubeconfig, []byte(`apiVersion: v1
+kind: Config
+clusters:
+- name: test
+  cluster:
+    server: https://127.0.0.1:6443
+users:
+- name: test
+contexts:
+- name: test
+  context:
+    cluster: test
+    user: test
+    namespace: storage
+current-context: test
+`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name          string
+		namespace     string
+		namespaceFile string
+		kubeconfig    string
+		expectError   bool
+		expected      string
+	}{
+		{
+			name:          "flag",
+			namespace:     "csi",
+			namespaceFile: namespaceFile,
+			kubeconfig:    kubeconfig,
+			expected:      "csi",
+		},
+		{
+			name:          "pod namespace",
+			namespaceFile: namespaceFile,
+			kubeconfig:    kubeconfig,
+			expected:      "kube-system",
+		},
+		{
+			name:          "kubeconfig context",
+			namespaceFile: emptyFile,
+			kubeconfig:    kubeconfig,
+			expected:      "storage",
+		},
+		{
+			name:          "no namespace",
+			namespaceFile: filepath.Join(dir, "missing"),
+			kubeconfig:    emptyFile,
+			expectError:   true,
+		},
+	}
+
+	defer func(file string) { serviceAccountNamespaceFile = file }(serviceAccountNamespaceFile)
+	for _, test := range tests {
+		serviceAccountNamespaceFile = test.namespaceFile
+		namespace, err := ownNamespace(test.namespace, test.kubeconfig)
+		if test.expectError && err == nil {
+			t.Errorf("test %q: Expected error, got none", test.name)
+		}
+		if !test.expectError && err != nil {
+			t.Errorf("test %q: got error: %v", test.name, err)
+		}
+		if namespace != test.expected {
+			t.Errorf("test %q: expected namespace %q, got %q", test.name, test.expected, namespace)
+		}
+	}
+}
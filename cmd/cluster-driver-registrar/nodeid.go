@@ -0,0 +1,171 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/golang/glog"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/rest"
+
+	"github.com/kubernetes-csi/cluster-driver-registrar/pkg/connection"
+)
+
+// Annotation on the Node object which maps CSI driver names to the node
+// IDs reported by the drivers, encoded as JSON.
+const nodeIDAnnotation = "csi.volume.kubernetes.io/nodeid"
+
+// nodeIDUpdater stores the node ID of a CSI driver for a node.
+type nodeIDUpdater interface {
+	UpdateNodeID(nodeName, driverName, nodeID string) error
+}
+
+// apiNodeIDUpdater stores node IDs in the nodeIDAnnotation of Node
+// objects.
+type apiNodeIDUpdater struct {
+	client  rest.Interface
+	timeout time.Duration
+}
+
+var (
+	_ nodeIDUpdater = &apiNodeIDUpdater{}
+)
+
+// newAPINodeIDUpdater creates an updater whose API calls time out after
+// the given duration. 0 disables the timeout.
+func newAPINodeIDUpdater(config *rest.Config, timeout time.Duration) (nodeIDUpdater, error) {
+	client, err := newCoreRESTClient(config)
+	if err != nil {
+		return nil, err
+	}
+	return &apiNodeIDUpdater{client: client, timeout: timeout}, nil
+}
+
+func (u *apiNodeIDUpdater) UpdateNodeID(nodeName, driverName, nodeID string) error {
+	// Other drivers store their node IDs in the same annotation, so
+	// retry with the latest content on conflicts.
+	return retryOnError(registerBackoff, isRetriable, func() error {
+		node := &corev1.Node{}
+		err := u.client.Get().
+			Resource("nodes").
+			Name(nodeName).
+			Timeout(u.timeout).
+			Do().
+			Into(node)
+		if err != nil {
+			return err
+		}
+		value, changed, err := setNodeID(node.Annotations[nodeIDAnnotation], driverName, nodeID)
+		if err != nil || !changed {
+			return err
+		}
+		patch, err := nodeIDPatch(node.ResourceVersion, value)
+		if err != nil {
+			return err
+		}
+		return u.client.Patch(types.MergePatchType).
+			Resource("nodes").
+			Name(nodeName).
+			Body(patch).
+			Timeout(u.timeout).
+			Do().
+			Error()
+	})
+}
+
+// nodeIDPatch creates a JSON merge patch which only sets the
+// nodeIDAnnotation. The resource version makes the API server reject
+// the patch with a conflict if the node was modified after reading it,
+// so a concurrent change of the annotation by another driver is not
+// lost.
+func nodeIDPatch(resourceVersion, value string) ([]byte, error) {
+	type metadata struct {
+		ResourceVersion string            `json:"resourceVersion"`
+		Annotations     map[string]string `json:"annotations"`
+	}
+	return json.Marshal(struct {
+		Metadata metadata `json:"metadata"`
+	}{
+		Metadata: metadata{
+			ResourceVersion: resourceVersion,
+			Annotations:     map[string]string{nodeIDAnnotation: value},
+		},
+	})
+}
+
+// setNodeID returns the annotation value with the node ID of the driver
+// set and whether that changed the value.
+func setNodeID(annotation, driverName, nodeID string) (string, bool, error) {
+	nodeIDs := map[string]string{}
+	if annotation != "" {
+		if err := json.Unmarshal([]byte(annotation), &nodeIDs); err != nil {
+			return "", false, fmt.Errorf("failed to parse %s annotation %q: %v", nodeIDAnnotation, annotation, err)
+		}
+	}
+	if nodeIDs[driverName] == nodeID {
+		return annotation, false, nil
+	}
+	nodeIDs[driverName] = nodeID
+	value, err := json.Marshal(nodeIDs)
+	if err != nil {
+		return "", false, err
+	}
+	return string(value), true, nil
+}
+
+// nodeIDVerifier checks the node ID reported by the CSI driver and
+// stores it whenever it changes.
+type nodeIDVerifier struct {
+	csiConn    connection.CSIConnection
+	updater    nodeIDUpdater
+	nodeName   string
+	driverName string
+
+	// nodeID is the last node ID that was stored successfully.
+	nodeID string
+}
+
+// verify calls NodeGetInfo and updates the node ID if it is different
+// from the one stored before.
+func (v *nodeIDVerifier) verify(ctx context.Context, csiTimeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, csiTimeout)
+	defer cancel()
+
+	nodeID, err := v.csiConn.NodeGetId(ctx)
+	if err != nil {
+		glog.Warningf("Failed to get node ID from CSI driver: %v", err)
+		return err
+	}
+	if nodeID == v.nodeID {
+		return nil
+	}
+	if v.nodeID != "" {
+		glog.Infof("CSI driver changed node ID from %q to %q", v.nodeID, nodeID)
+	}
+	if err := v.updater.UpdateNodeID(v.nodeName, v.driverName, nodeID); err != nil {
+		glog.Errorf("Failed to store node ID of node %s: %v", v.nodeName, err)
+		return err
+	}
+	glog.V(1).Infof("Stored node ID %q for node %s", nodeID, v.nodeName)
+	v.nodeID = nodeID
+	return nil
+}
@@ -0,0 +1,233 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/rest"
+)
+
+func TestSetNodeID(t *testing.T) {
+	tests := []struct {
+		name            string
+		annotation      string
+		expectError     bool
+		expectedValue   string
+		expectedChanged bool
+	}{
+		{
+			name:            "no annotation",
+			expectedValue:   `{"csi.example.com":"node-1"}`,
+			expectedChanged: true,
+		},
+		{
+			name:          "unchanged",
+			annotation:    `{"csi.example.com":"node-1"}`,
+			expectedValue: `{"csi.example.com":"node-1"}`,
+		},
+		{
+			name:            "changed",
+			annotation:      `{"csi.example.com":"node-0"}`,
+			expectedValue:   `{"csi.example.com":"node-1"}`,
+			expectedChanged: true,
+		},
+		{
+			name:            "other driver",
+			annotation:      `{"other.example.com":"x"}`,
+			expectedValue:   `{"csi.example.com":"node-1","other.example.com":"x"}`,
+			expectedChanged: true,
+		},
+		{
+			name:        "invalid annotation",
+			annotation:  `not json`,
+			expectError: true,
+		},
+	}
+
+	for _, test := range tests {
+		value, changed, err := setNodeID(test.annotation, "csi.example.com", "node-1")
+		if test.expectError && err == nil {
+			t.Errorf("test %q: Expected error, got none", test.name)
+		}
+		if !test.expectError && err != nil {
+			t.Errorf("test %q: got error: %v", test.name, err)
+		}
+		if value != test.expectedValue {
+			t.Errorf("test %q: expected value %q, got %q", test.name, test.expectedValue, value)
+		}
+		if changed != test.expectedChanged {
+			t.Errorf("test %q: expected changed %t, got %t", test.name, test.expectedChanged, changed)
+		}
+	}
+}
+
+func TestAPINodeIDUpdater(t *testing.T) {
+	node := &corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            "node",
+			ResourceVersion: "42",
+			Annotations:     map[string]string{nodeIDAnnotation: `{"other.example.com":"other"}`},
+		},
+	}
+	object, err := json.Marshal(node)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var patchType string
+	var patch map[string]interface{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET":
+		case "PATCH":
+			patchType = r.Header.Get("Content-Type")
+			body, _ := ioutil.ReadAll(r.Body)
+			if err := json.Unmarshal(body, &patch); err != nil {
+				t.Error(err)
+			}
+		default:
+			http.Error(w, "unexpected method "+r.Method, http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(object)
+	}))
+	defer server.Close()
+
+	updater, err := newAPINodeIDUpdater(&rest.Config{Host: server.URL}, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := updater.UpdateNodeID("node", "csi.example.com", "node-1"); err != nil {
+		t.Fatalf("update failed: %v", err)
+	}
+
+	if patchType != string(types.MergePatchType) {
+		t.Errorf("expected merge patch, got %q", patchType)
+	}
+	// Only the annotation gets patched, with the resource version
+	// for detecting conflicts.
+	expected := map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"resourceVersion": "42",
+			"annotations": map[string]interface{}{
+				nodeIDAnnotation: `{"csi.example.com":"node-1","other.example.com":"other"}`,
+			},
+		},
+	}
+	if !reflect.DeepEqual(patch, expected) {
+		t.Errorf("expected patch %v, got %v", expected, patch)
+	}
+}
+
+// fakeNodeIDUpdater records the node IDs that it was asked to store.
+type fakeNodeIDUpdater struct {
+	nodeIDs []string
+	err     error
+}
+
+func (f *fakeNodeIDUpdater) UpdateNodeID(nodeName, driverName, nodeID string) error {
+	if f.err != nil {
+		return f.err
+	}
+	f.nodeIDs = append(f.nodeIDs, nodeID)
+	return nil
+}
+
+func TestNodeIDVerifier(t *testing.T) {
+	tests := []struct {
+		name            string
+		storedNodeID    string
+		csiConn         *fakeCSIConnection
+		updateErr       error
+		expectError     bool
+		expectedUpdates int
+		expectedNodeID  string
+	}{
+		{
+			name:            "initial",
+			csiConn:         &fakeCSIConnection{nodeID: "node-1"},
+			expectedUpdates: 1,
+			expectedNodeID:  "node-1",
+		},
+		{
+			name:           "unchanged",
+			storedNodeID:   "node-1",
+			csiConn:        &fakeCSIConnection{nodeID: "node-1"},
+			expectedNodeID: "node-1",
+		},
+		{
+			name:            "changed",
+			storedNodeID:    "node-0",
+			csiConn:         &fakeCSIConnection{nodeID: "node-1"},
+			expectedUpdates: 1,
+			expectedNodeID:  "node-1",
+		},
+		{
+			name:           "CSI error",
+			storedNodeID:   "node-0",
+			csiConn:        &fakeCSIConnection{err: fmt.Errorf("mock error")},
+			expectError:    true,
+			expectedNodeID: "node-0",
+		},
+		{
+			name:           "update error",
+			storedNodeID:   "node-0",
+			csiConn:        &fakeCSIConnection{nodeID: "node-1"},
+			updateErr:      fmt.Errorf("mock error"),
+			expectError:    true,
+			expectedNodeID: "node-0",
+		},
+	}
+
+	for _, test := range tests {
+		updater := &fakeNodeIDUpdater{err: test.updateErr}
+		verifier := &nodeIDVerifier{
+			csiConn:    test.csiConn,
+			updater:    updater,
+			nodeName:   "node",
+			driverName: "csi.example.com",
+			nodeID:     test.storedNodeID,
+		}
+
+		err := verifier.verify(context.Background(), time.Second)
+		if test.expectError && err == nil {
+			t.Errorf("test %q: Expected error, got none", test.name)
+		}
+		if !test.expectError && err != nil {
+			t.Errorf("test %q: got error: %v", test.name, err)
+		}
+		if len(updater.nodeIDs) != test.expectedUpdates {
+			t.Errorf("test %q: expected %d updates, got %d", test.name, test.expectedUpdates, len(updater.nodeIDs))
+		}
+		if verifier.nodeID != test.expectedNodeID {
+			t.Errorf("test %q: expected node ID %q, got %q", test.name, test.expectedNodeID, verifier.nodeID)
+		}
+	}
+}
@@ -0,0 +1,141 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"sync"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/golang/glog"
+
+	"github.com/kubernetes-csi/cluster-driver-registrar/pkg/connection"
+)
+
+// connectFunc establishes a new connection to the CSI driver and
+// discovers its name.
+type connectFunc func(ctx context.Context) (connection.CSIConnection, string, error)
+
+// driverConnection is a CSIConnection which can be replaced by a new
+// connection when the CSI driver was restarted. All calls go to the
+// current connection.
+type driverConnection struct {
+	connect connectFunc
+
+	mutex sync.Mutex
+	conn  connection.CSIConnection
+	name  string
+}
+
+var (
+	_ connection.CSIConnection = &driverConnection{}
+)
+
+func newDriverConnection(conn connection.CSIConnection, name string, connect connectFunc) *driverConnection {
+	return &driverConnection{
+		connect: connect,
+		conn:    conn,
+		name:    name,
+	}
+}
+
+func (c *driverConnection) current() connection.CSIConnection {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.conn
+}
+
+// reconnect establishes a new connection and discovers the driver name
+// again. The old connection is only closed once the new one works, so
+// a failed attempt leaves everything as it was. A driver name which
+// differs from the one discovered before is logged as a warning.
+func (c *driverConnection) reconnect(ctx context.Context) error {
+	conn, name, err := c.connect(ctx)
+	if err != nil {
+		return err
+	}
+
+	c.mutex.Lock()
+	old, oldName := c.conn, c.name
+	c.conn, c.name = conn, name
+	c.mutex.Unlock()
+
+	if name != oldName {
+		glog.Warningf("CSI driver name changed from %q to %q after reconnecting", oldName, name)
+	}
+	if old != nil {
+		old.Close()
+	}
+	glog.V(1).Infof("Reconnected to CSI driver %s", name)
+	return nil
+}
+
+// GetDriverName asks the driver for its name, the same way as during
+// the initial discovery. If that fails, the last name that was
+// discovered successfully is returned instead, so a transient failure
+// does not affect the registration. Only a successfully discovered
+// name which differs is logged as a change.
+func (c *driverConnection) GetDriverName(ctx context.Context) (string, error) {
+	name, err := discoverDriverName(ctx, c.current(), *driverNameManifestKey)
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if err != nil {
+		if c.name == "" {
+			return "", err
+		}
+		glog.V(2).Infof("Failed to get CSI driver name, using last known name %q: %v", c.name, err)
+		return c.name, nil
+	}
+	if name != c.name {
+		glog.Warningf("CSI driver name changed from %q to %q", c.name, name)
+		c.name = name
+	}
+	return name, nil
+}
+
+func (c *driverConnection) GetDriverVersion(ctx context.Context) (string, error) {
+	return c.current().GetDriverVersion(ctx)
+}
+
+func (c *driverConnection) GetDriverManifest(ctx context.Context) (map[string]string, error) {
+	return c.current().GetDriverManifest(ctx)
+}
+
+func (c *driverConnection) Probe(ctx context.Context) (bool, error) {
+	return c.current().Probe(ctx)
+}
+
+func (c *driverConnection) NodeGetId(ctx context.Context) (string, error) {
+	return c.current().NodeGetId(ctx)
+}
+
+func (c *driverConnection) IsAttachRequired(ctx context.Context) (bool, error) {
+	return c.current().IsAttachRequired(ctx)
+}
+
+func (c *driverConnection) GetControllerCapabilities(ctx context.Context) ([]csi.ControllerServiceCapability_RPC_Type, error) {
+	return c.current().GetControllerCapabilities(ctx)
+}
+
+func (c *driverConnection) SupportsVolumeAccessibilityConstraints(ctx context.Context) (bool, error) {
+	return c.current().SupportsVolumeAccessibilityConstraints(ctx)
+}
+
+func (c *driverConnection) Close() error {
+	return c.current().Close()
+}
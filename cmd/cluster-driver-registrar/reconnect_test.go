@@ -0,0 +1,196 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+
+	"github.com/kubernetes-csi/cluster-driver-registrar/pkg/connection"
+)
+
+// fakeCSIConnection returns fixed results.
+type fakeCSIConnection struct {
+	name           string
+	version        string
+	manifest       map[string]string
+	nodeID         string
+	attachRequired bool
+	topology       bool
+	err            error
+	closed         bool
+}
+
+var (
+	_ connection.CSIConnection = &fakeCSIConnection{}
+)
+
+func (f *fakeCSIConnection) GetDriverName(ctx context.Context) (string, error) {
+	return f.name, f.err
+}
+
+func (f *fakeCSIConnection) GetDriverVersion(ctx context.Context) (string, error) {
+	return f.version, f.err
+}
+
+func (f *fakeCSIConnection) GetDriverManifest(ctx context.Context) (map[string]string, error) {
+	return f.manifest, f.err
+}
+
+func (f *fakeCSIConnection) Probe(ctx context.Context) (bool, error) {
+	return f.err == nil, f.err
+}
+
+func (f *fakeCSIConnection) NodeGetId(ctx context.Context) (string, error) {
+	return f.nodeID, f.err
+}
+
+func (f *fakeCSIConnection) IsAttachRequired(ctx context.Context) (bool, error) {
+	return f.attachRequired, f.err
+}
+
+func (f *fakeCSIConnection) GetControllerCapabilities(ctx context.Context) ([]csi.ControllerServiceCapability_RPC_Type, error) {
+	if f.attachRequired {
+		return []csi.ControllerServiceCapability_RPC_Type{csi.ControllerServiceCapability_RPC_PUBLISH_UNPUBLISH_VOLUME}, f.err
+	}
+	return nil, f.err
+}
+
+func (f *fakeCSIConnection) SupportsVolumeAccessibilityConstraints(ctx context.Context) (bool, error) {
+	return f.topology, f.err
+}
+
+func (f *fakeCSIConnection) Close() error {
+	f.closed = true
+	return nil
+}
+
+func TestDriverConnectionReconnect(t *testing.T) {
+	tests := []struct {
+		name         string
+		newConn      *fakeCSIConnection
+		connectErr   error
+		expectError  bool
+		expectedName string
+	}{
+		{
+			name:         "success",
+			newConn:      &fakeCSIConnection{name: "csi.example.com", attachRequired: true},
+			expectedName: "csi.example.com",
+		},
+		{
+			name:         "name changed",
+			newConn:      &fakeCSIConnection{name: "other.example.com", attachRequired: true},
+			expectedName: "other.example.com",
+		},
+		{
+			name:         "connect error",
+			connectErr:   fmt.Errorf("mock error"),
+			expectError:  true,
+			expectedName: "csi.example.com",
+		},
+	}
+
+	for _, test := range tests {
+		oldConn := &fakeCSIConnection{name: "csi.example.com", err: fmt.Errorf("connection broken")}
+		connect := func(ctx context.Context) (connection.CSIConnection, string, error) {
+			if test.connectErr != nil {
+				return nil, "", test.connectErr
+			}
+			return test.newConn, test.newConn.name, nil
+		}
+		csiConn := newDriverConnection(oldConn, oldConn.name, connect)
+
+		err := csiConn.reconnect(context.Background())
+		if test.expectError && err == nil {
+			t.Errorf("test %q: Expected error, got none", test.name)
+		}
+		if !test.expectError && err != nil {
+			t.Errorf("test %q: got error: %v", test.name, err)
+		}
+		if oldConn.closed == test.expectError {
+			t.Errorf("test %q: expected old connection closed %t, got %t", test.name, !test.expectError, oldConn.closed)
+		}
+		if csiConn.name != test.expectedName {
+			t.Errorf("test %q: expected driver name %q, got %q", test.name, test.expectedName, csiConn.name)
+		}
+
+		// Calls must go to the new connection after a successful
+		// reconnect and to the old one otherwise.
+		_, err = csiConn.IsAttachRequired(context.Background())
+		if test.expectError && err == nil {
+			t.Errorf("test %q: expected call to fail on old connection", test.name)
+		}
+		if !test.expectError && err != nil {
+			t.Errorf("test %q: call on new connection failed: %v", test.name, err)
+		}
+	}
+}
+
+func TestDriverConnectionGetDriverName(t *testing.T) {
+	tests := []struct {
+		name         string
+		cachedName   string
+		conn         *fakeCSIConnection
+		expectError  bool
+		expectedName string
+	}{
+		{
+			name:         "same name",
+			cachedName:   "csi.example.com",
+			conn:         &fakeCSIConnection{name: "csi.example.com"},
+			expectedName: "csi.example.com",
+		},
+		{
+			name:         "transient failure",
+			cachedName:   "csi.example.com",
+			conn:         &fakeCSIConnection{err: fmt.Errorf("mock error")},
+			expectedName: "csi.example.com",
+		},
+		{
+			name:         "renamed",
+			cachedName:   "csi.example.com",
+			conn:         &fakeCSIConnection{name: "other.example.com"},
+			expectedName: "other.example.com",
+		},
+		{
+			name:        "failure without known name",
+			conn:        &fakeCSIConnection{err: fmt.Errorf("mock error")},
+			expectError: true,
+		},
+	}
+
+	for _, test := range tests {
+		csiConn := newDriverConnection(test.conn, test.cachedName, nil)
+		name, err := csiConn.GetDriverName(context.Background())
+		if test.expectError && err == nil {
+			t.Errorf("test %q: Expected error, got none", test.name)
+		}
+		if !test.expectError && err != nil {
+			t.Errorf("test %q: got error: %v", test.name, err)
+		}
+		if name != test.expectedName {
+			t.Errorf("test %q: expected name %q, got %q", test.name, test.expectedName, name)
+		}
+		if !test.expectError && csiConn.name != test.expectedName {
+			t.Errorf("test %q: expected cached name %q, got %q", test.name, test.expectedName, csiConn.name)
+		}
+	}
+}
@@ -0,0 +1,291 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/golang/glog"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/rest"
+	k8scsi "k8s.io/csi-api/pkg/apis/csi/v1alpha1"
+	k8scsiclient "k8s.io/csi-api/pkg/client/clientset/versioned"
+	k8scsiclientv1alpha1 "k8s.io/csi-api/pkg/client/clientset/versioned/typed/csi/v1alpha1"
+)
+
+// Registrar abstracts the Kubernetes API calls for CSIDriver objects.
+// Errors are the usual API errors, so callers can check them with
+// k8s.io/apimachinery/pkg/api/errors.
+type Registrar interface {
+	// Get returns the CSIDriver object with the given name.
+	Get(name string) (*k8scsi.CSIDriver, error)
+
+	// Create creates a new CSIDriver object.
+	Create(csiDriver *k8scsi.CSIDriver) (*k8scsi.CSIDriver, error)
+
+	// Update sets the fields of an existing CSIDriver object which
+	// are owned by the registrar to the values in csiDriver, see
+	// applyOwnedFields. Everything else is left unchanged.
+	Update(csiDriver *k8scsi.CSIDriver) (*k8scsi.CSIDriver, error)
+
+	// Delete removes the CSIDriver object with the given name.
+	Delete(name string) error
+
+	// Watch returns a watch for changes of the CSIDriver object with
+	// the given name.
+	Watch(name string) (watch.Interface, error)
+}
+
+// alphaRegistrar manages CSIDriver objects of the
+// csi.storage.k8s.io/v1alpha1 CRD.
+type alphaRegistrar struct {
+	csiDrivers k8scsiclientv1alpha1.CSIDriverInterface
+	// restClient is used for calls which need the fieldManager
+	// parameter, because the vendored typed client cannot set it.
+	restClient   rest.Interface
+	fieldManager string
+}
+
+var (
+	_ Registrar = &alphaRegistrar{}
+)
+
+// newAlphaRegistrar creates a registrar which identifies itself as
+// fieldManager in create and patch calls. API servers which track
+// managed fields attribute the fields set by these calls to that
+// manager; older servers ignore it.
+func newAlphaRegistrar(clientset k8scsiclient.Interface, fieldManager string) Registrar {
+	return &alphaRegistrar{
+		csiDrivers:   clientset.CsiV1alpha1().CSIDrivers(),
+		restClient:   clientset.CsiV1alpha1().RESTClient(),
+		fieldManager: fieldManager,
+	}
+}
+
+func (r *alphaRegistrar) Get(name string) (*k8scsi.CSIDriver, error) {
+	return r.csiDrivers.Get(name, metav1.GetOptions{})
+}
+
+func (r *alphaRegistrar) Create(csiDriver *k8scsi.CSIDriver) (*k8scsi.CSIDriver, error) {
+	result := &k8scsi.CSIDriver{}
+	err := r.restClient.Post().
+		Resource(k8scsi.CsiDriverResourcePlural).
+		Param("fieldManager", r.fieldManager).
+		Body(csiDriver).
+		Do().
+		Into(result)
+	return result, err
+}
+
+// Update uses a JSON merge patch instead of replacing the object, so
+// it neither conflicts with nor clobbers changes made by others.
+func (r *alphaRegistrar) Update(csiDriver *k8scsi.CSIDriver) (*k8scsi.CSIDriver, error) {
+	patch, err := ownedFieldsPatch(csiDriver)
+	if err != nil {
+		return nil, err
+	}
+	result := &k8scsi.CSIDriver{}
+	err = r.restClient.Patch(types.MergePatchType).
+		Resource(k8scsi.CsiDriverResourcePlural).
+		Name(csiDriver.Name).
+		Param("fieldManager", r.fieldManager).
+		Body(patch).
+		Do().
+		Into(result)
+	return result, err
+}
+
+func (r *alphaRegistrar) Delete(name string) error {
+	return r.csiDrivers.Delete(name, &metav1.DeleteOptions{})
+}
+
+func (r *alphaRegistrar) Watch(name string) (watch.Interface, error) {
+	return r.csiDrivers.Watch(metav1.ListOptions{
+		FieldSelector: fields.OneTermEqualSelector("metadata.name", name).String(),
+	})
+}
+
+// applyOwnedFields returns a copy of existing with the spec, labels
+// and annotations from desired. Labels and annotations which are not
+// in desired are kept.
+func applyOwnedFields(existing, desired *k8scsi.CSIDriver) *k8scsi.CSIDriver {
+	updated := existing.DeepCopy()
+	desired.Spec.DeepCopyInto(&updated.Spec)
+	updated.Labels = mergeMap(updated.Labels, desired.Labels)
+	updated.Annotations = mergeMap(updated.Annotations, desired.Annotations)
+	return updated
+}
+
+// ownedFieldsPatch creates a JSON merge patch which has the same effect
+// as applyOwnedFields.
+func ownedFieldsPatch(csiDriver *k8scsi.CSIDriver) ([]byte, error) {
+	type metadata struct {
+		Labels      map[string]string `json:"labels,omitempty"`
+		Annotations map[string]string `json:"annotations,omitempty"`
+	}
+	return json.Marshal(struct {
+		Metadata metadata             `json:"metadata"`
+		Spec     k8scsi.CSIDriverSpec `json:"spec"`
+	}{
+		Metadata: metadata{
+			Labels:      csiDriver.Labels,
+			Annotations: csiDriver.Annotations,
+		},
+		Spec: csiDriver.Spec,
+	})
+}
+
+// dryRunRegistrar only logs the calls that would modify the cluster.
+// It never finds an existing CSIDriver object.
+type dryRunRegistrar struct{}
+
+var (
+	_ Registrar = dryRunRegistrar{}
+)
+
+func (dryRunRegistrar) Get(name string) (*k8scsi.CSIDriver, error) {
+	return nil, apierrors.NewNotFound(k8scsi.Resource(k8scsi.CsiDriverResourcePlural), name)
+}
+
+func (dryRunRegistrar) Create(csiDriver *k8scsi.CSIDriver) (*k8scsi.CSIDriver, error) {
+	glog.Infof("Dry run: would create CSIDriver object %+v", *csiDriver)
+	return csiDriver, nil
+}
+
+func (dryRunRegistrar) Update(csiDriver *k8scsi.CSIDriver) (*k8scsi.CSIDriver, error) {
+	glog.Infof("Dry run: would update CSIDriver object %+v", *csiDriver)
+	return csiDriver, nil
+}
+
+func (dryRunRegistrar) Delete(name string) error {
+	glog.Infof("Dry run: would delete CSIDriver object %s", name)
+	return nil
+}
+
+func (dryRunRegistrar) Watch(name string) (watch.Interface, error) {
+	return watch.NewEmptyWatch(), nil
+}
+
+// timeoutRegistrar stops waiting for API calls which take longer than
+// the timeout and returns a timeout error instead, so that a wedged API
+// server cannot stall registration forever. The vendored client does
+// not support cancelling calls, so a hung call keeps running in the
+// background until it completes on its own. Watch is not limited
+// because it is expected to run for a long time.
+type timeoutRegistrar struct {
+	Registrar
+	timeout time.Duration
+}
+
+var (
+	_ Registrar = &timeoutRegistrar{}
+)
+
+func (r *timeoutRegistrar) Get(name string) (*k8scsi.CSIDriver, error) {
+	return r.call("get", name, func() (*k8scsi.CSIDriver, error) {
+		return r.Registrar.Get(name)
+	})
+}
+
+func (r *timeoutRegistrar) Create(csiDriver *k8scsi.CSIDriver) (*k8scsi.CSIDriver, error) {
+	return r.call("create", csiDriver.Name, func() (*k8scsi.CSIDriver, error) {
+		return r.Registrar.Create(csiDriver)
+	})
+}
+
+func (r *timeoutRegistrar) Update(csiDriver *k8scsi.CSIDriver) (*k8scsi.CSIDriver, error) {
+	return r.call("update", csiDriver.Name, func() (*k8scsi.CSIDriver, error) {
+		return r.Registrar.Update(csiDriver)
+	})
+}
+
+func (r *timeoutRegistrar) Delete(name string) error {
+	_, err := r.call("delete", name, func() (*k8scsi.CSIDriver, error) {
+		return nil, r.Registrar.Delete(name)
+	})
+	return err
+}
+
+func (r *timeoutRegistrar) call(verb, name string, fn func() (*k8scsi.CSIDriver, error)) (*k8scsi.CSIDriver, error) {
+	type result struct {
+		csiDriver *k8scsi.CSIDriver
+		err       error
+	}
+	done := make(chan result, 1)
+	go func() {
+		csiDriver, err := fn()
+		done <- result{csiDriver, err}
+	}()
+
+	timer := time.NewTimer(r.timeout)
+	defer timer.Stop()
+	select {
+	case res := <-done:
+		return res.csiDriver, res.err
+	case <-timer.C:
+		msg := fmt.Sprintf("%s of CSIDriver object %s did not complete within %v", verb, name, r.timeout)
+		glog.Warningf("Giving up: %s", msg)
+		return nil, apierrors.NewTimeoutError(msg, 0)
+	}
+}
+
+// confirmingRegistrar only returns from Create once the new object can
+// be read back, for users which depend on the object being visible as
+// soon as the registrar reports success.
+type confirmingRegistrar struct {
+	Registrar
+	interval time.Duration
+	timeout  time.Duration
+}
+
+var (
+	_ Registrar = &confirmingRegistrar{}
+)
+
+func (r *confirmingRegistrar) Create(csiDriver *k8scsi.CSIDriver) (*k8scsi.CSIDriver, error) {
+	created, err := r.Registrar.Create(csiDriver)
+	if err != nil {
+		return created, err
+	}
+	var lastErr error
+	err = wait.PollImmediate(r.interval, r.timeout, func() (bool, error) {
+		_, err := r.Registrar.Get(csiDriver.Name)
+		if apierrors.IsNotFound(err) {
+			return false, nil
+		} else if err != nil {
+			lastErr = err
+			return false, nil
+		}
+		return true, nil
+	})
+	if err == wait.ErrWaitTimeout {
+		msg := fmt.Sprintf("created CSIDriver object %s could not be read back within %v", csiDriver.Name, r.timeout)
+		if lastErr != nil {
+			msg = fmt.Sprintf("%s: %v", msg, lastErr)
+		}
+		return nil, apierrors.NewTimeoutError(msg, 0)
+	}
+	glog.V(1).Infof("Confirmed that CSIDriver object %s can be read", csiDriver.Name)
+	return created, nil
+}
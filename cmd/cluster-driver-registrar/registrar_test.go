@@ -0,0 +1,315 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/rest"
+	k8scsi "k8s.io/csi-api/pkg/apis/csi/v1alpha1"
+	k8scsiclient "k8s.io/csi-api/pkg/client/clientset/versioned"
+)
+
+var csiDriverResource = k8scsi.Resource(k8scsi.CsiDriverResourcePlural)
+
+// fakeRegistrar keeps CSIDriver objects in memory. Errors can be
+// injected for each operation.
+type fakeRegistrar struct {
+	objects map[string]*k8scsi.CSIDriver
+
+	getErr    error
+	createErr error
+	updateErr error
+	deleteErr error
+	watchErr  error
+
+	watcher *watch.FakeWatcher
+	// watchDeletes enables Deleted events for successful deletes
+	// while a watch is active, like the API server sends them.
+	watchDeletes bool
+	watching     bool
+
+	creates int
+	updates int
+	deletes int
+}
+
+var (
+	_ Registrar = &fakeRegistrar{}
+)
+
+func newFakeRegistrar(objects ...*k8scsi.CSIDriver) *fakeRegistrar {
+	r := &fakeRegistrar{
+		objects: map[string]*k8scsi.CSIDriver{},
+		watcher: watch.NewFakeWithChanSize(10, false),
+	}
+	for _, obj := range objects {
+		r.objects[obj.Name] = obj.DeepCopy()
+	}
+	return r
+}
+
+func (r *fakeRegistrar) Get(name string) (*k8scsi.CSIDriver, error) {
+	if r.getErr != nil {
+		return nil, r.getErr
+	}
+	obj, ok := r.objects[name]
+	if !ok {
+		return nil, apierrors.NewNotFound(csiDriverResource, name)
+	}
+	return obj.DeepCopy(), nil
+}
+
+func (r *fakeRegistrar) Create(csiDriver *k8scsi.CSIDriver) (*k8scsi.CSIDriver, error) {
+	if r.createErr != nil {
+		return nil, r.createErr
+	}
+	if _, ok := r.objects[csiDriver.Name]; ok {
+		return nil, apierrors.NewAlreadyExists(csiDriverResource, csiDriver.Name)
+	}
+	r.creates++
+	r.objects[csiDriver.Name] = csiDriver.DeepCopy()
+	return csiDriver.DeepCopy(), nil
+}
+
+func (r *fakeRegistrar) Update(csiDriver *k8scsi.CSIDriver) (*k8scsi.CSIDriver, error) {
+	if r.updateErr != nil {
+		return nil, r.updateErr
+	}
+	if _, ok := r.objects[csiDriver.Name]; !ok {
+		return nil, apierrors.NewNotFound(csiDriverResource, csiDriver.Name)
+	}
+	r.updates++
+	r.objects[csiDriver.Name] = applyOwnedFields(r.objects[csiDriver.Name], csiDriver)
+	return r.objects[csiDriver.Name].DeepCopy(), nil
+}
+
+func (r *fakeRegistrar) Delete(name string) error {
+	if r.deleteErr != nil {
+		return r.deleteErr
+	}
+	obj, ok := r.objects[name]
+	if !ok {
+		return apierrors.NewNotFound(csiDriverResource, name)
+	}
+	r.deletes++
+	delete(r.objects, name)
+	if r.watchDeletes && r.watching && !r.watcher.IsStopped() {
+		r.watcher.Delete(obj)
+	}
+	return nil
+}
+
+func (r *fakeRegistrar) Watch(name string) (watch.Interface, error) {
+	if r.watchErr != nil {
+		return nil, r.watchErr
+	}
+	if r.watcher.IsStopped() {
+		// Like a new watch from the API server.
+		r.watcher.Reset()
+	}
+	r.watching = true
+	return r.watcher, nil
+}
+
+// mergePatch applies a JSON merge patch as defined in RFC 7386.
+func mergePatch(target, patch interface{}) interface{} {
+	patchMap, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+	targetMap, ok := target.(map[string]interface{})
+	if !ok {
+		targetMap = map[string]interface{}{}
+	}
+	for key, value := range patchMap {
+		if value == nil {
+			delete(targetMap, key)
+		} else {
+			targetMap[key] = mergePatch(targetMap[key], value)
+		}
+	}
+	return targetMap
+}
+
+func TestAlphaRegistrarUpdate(t *testing.T) {
+	existing := makeCSIDriver("csi.example.com", false, map[string]string{"other": "x"})
+	existing.Finalizers = []string{"example.com/protect"}
+	object, err := json.Marshal(existing)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var patchType, fieldManager string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "PATCH" {
+			http.Error(w, "unexpected method "+r.Method, http.StatusMethodNotAllowed)
+			return
+		}
+		patchType = r.Header.Get("Content-Type")
+		fieldManager = r.URL.Query().Get("fieldManager")
+		var current, patch interface{}
+		body, _ := ioutil.ReadAll(r.Body)
+		if err := json.Unmarshal(object, &current); err != nil {
+			t.Error(err)
+		}
+		if err := json.Unmarshal(body, &patch); err != nil {
+			t.Error(err)
+		}
+		object, _ = json.Marshal(mergePatch(current, patch))
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(object)
+	}))
+	defer server.Close()
+
+	clientset, err := k8scsiclient.NewForConfig(&rest.Config{Host: server.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	registrar := newAlphaRegistrar(clientset, "test-manager")
+	updated, err := registrar.Update(makeCSIDriver("csi.example.com", true, map[string]string{"team": "storage"}))
+	if err != nil {
+		t.Fatalf("update failed: %v", err)
+	}
+
+	if patchType != string(types.MergePatchType) {
+		t.Errorf("expected merge patch, got %q", patchType)
+	}
+	if fieldManager != "test-manager" {
+		t.Errorf("expected field manager %q, got %q", "test-manager", fieldManager)
+	}
+	expected := makeCSIDriver("csi.example.com", true, map[string]string{"other": "x", "team": "storage"})
+	expected.Finalizers = []string{"example.com/protect"}
+	if !reflect.DeepEqual(updated, expected) {
+		t.Errorf("expected object %+v, got %+v", expected, updated)
+	}
+}
+
+// hangingRegistrar blocks in Create until unblocked.
+type hangingRegistrar struct {
+	*fakeRegistrar
+	unblock chan struct{}
+}
+
+func (r *hangingRegistrar) Create(csiDriver *k8scsi.CSIDriver) (*k8scsi.CSIDriver, error) {
+	<-r.unblock
+	return r.fakeRegistrar.Create(csiDriver)
+}
+
+func TestTimeoutRegistrar(t *testing.T) {
+	hanging := &hangingRegistrar{
+		fakeRegistrar: newFakeRegistrar(makeCSIDriver("existing.example.com", true, nil)),
+		unblock:       make(chan struct{}),
+	}
+	defer close(hanging.unblock)
+	registrar := &timeoutRegistrar{Registrar: hanging, timeout: 100 * time.Millisecond}
+
+	if _, err := registrar.Get("existing.example.com"); err != nil {
+		t.Errorf("get: got error: %v", err)
+	}
+	if _, err := registrar.Get("csi.example.com"); !apierrors.IsNotFound(err) {
+		t.Errorf("get: expected NotFound, got %v", err)
+	}
+
+	start := time.Now()
+	_, err := registrar.Create(makeCSIDriver("csi.example.com", true, nil))
+	if !apierrors.IsTimeout(err) {
+		t.Errorf("create: expected timeout error, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("create: took %v", elapsed)
+	}
+
+	if err := registrar.Delete("existing.example.com"); err != nil {
+		t.Errorf("delete: got error: %v", err)
+	}
+}
+
+// laggingRegistrar hides objects from the first gets, like an API
+// server with read-after-write latency.
+type laggingRegistrar struct {
+	*fakeRegistrar
+	hiddenGets int
+	gets       int
+}
+
+func (r *laggingRegistrar) Get(name string) (*k8scsi.CSIDriver, error) {
+	r.gets++
+	if r.gets <= r.hiddenGets {
+		return nil, apierrors.NewNotFound(k8scsi.Resource(k8scsi.CsiDriverResourcePlural), name)
+	}
+	return r.fakeRegistrar.Get(name)
+}
+
+func TestConfirmingRegistrar(t *testing.T) {
+	tests := []struct {
+		name          string
+		hiddenGets    int
+		createErr     error
+		expectError   bool
+		expectTimeout bool
+	}{
+		{
+			name: "visible immediately",
+		},
+		{
+			name:       "visible later",
+			hiddenGets: 2,
+		},
+		{
+			name:          "never visible",
+			hiddenGets:    1000,
+			expectError:   true,
+			expectTimeout: true,
+		},
+		{
+			name:        "create error",
+			createErr:   fmt.Errorf("mock error"),
+			expectError: true,
+		},
+	}
+
+	for _, test := range tests {
+		lagging := &laggingRegistrar{fakeRegistrar: newFakeRegistrar(), hiddenGets: test.hiddenGets}
+		lagging.createErr = test.createErr
+		registrar := &confirmingRegistrar{Registrar: lagging, interval: time.Millisecond, timeout: 100 * time.Millisecond}
+
+		_, err := registrar.Create(makeCSIDriver("csi.example.com", true, nil))
+		if test.expectError && err == nil {
+			t.Errorf("test %q: Expected error, got none", test.name)
+		}
+		if !test.expectError && err != nil {
+			t.Errorf("test %q: got error: %v", test.name, err)
+		}
+		if test.expectTimeout && !apierrors.IsTimeout(err) {
+			t.Errorf("test %q: expected timeout error, got %v", test.name, err)
+		}
+		if !test.expectError && lagging.gets != test.hiddenGets+1 {
+			t.Errorf("test %q: expected %d gets, got %d", test.name, test.hiddenGets+1, lagging.gets)
+		}
+	}
+}
@@ -0,0 +1,56 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// Maximum time to wait for in-flight HTTP requests during shutdown.
+const serverShutdownTimeout = 5 * time.Second
+
+// startHTTPServer binds to the given address and then serves requests
+// with the handler in the background.
+func startHTTPServer(address string, handler http.Handler) (*http.Server, error) {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	server := &http.Server{Handler: handler}
+	go func() {
+		if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			glog.Errorf("HTTP server on %s failed: %v", address, err)
+		}
+	}()
+	return server, nil
+}
+
+// shutdownHTTPServers stops all given servers.
+func shutdownHTTPServers(servers []*http.Server) {
+	ctx, cancel := context.WithTimeout(context.Background(), serverShutdownTimeout)
+	defer cancel()
+	for _, server := range servers {
+		if err := server.Shutdown(ctx); err != nil {
+			glog.Warningf("Failed to shut down HTTP server: %v", err)
+		}
+	}
+}
@@ -0,0 +1,140 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeSelfSignedCert creates a self-signed certificate and its key in
+// dir and returns the file names.
+func writeSelfSignedCert(t *testing.T, dir string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "csi.example.com"},
+		NotBefore:             time.Now(),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certFile := filepath.Join(dir, "tls.crt")
+	keyFile := filepath.Join(dir, "tls.key")
+	if err := ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+func TestLoadTLSCredentials(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cluster-driver-registrar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	certFile, keyFile := writeSelfSignedCert(t, dir)
+	garbage := filepath.Join(dir, "garbage")
+	if err := ioutil.WriteFile(garbage, []byte("not a certificate"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name        string
+		certFile    string
+		keyFile     string
+		caFile      string
+		expectError bool
+		expectCreds bool
+	}{
+		{
+			name: "insecure",
+		},
+		{
+			name:        "mutual TLS",
+			certFile:    certFile,
+			keyFile:     keyFile,
+			caFile:      certFile,
+			expectCreds: true,
+		},
+		{
+			name:        "CA only",
+			caFile:      certFile,
+			expectCreds: true,
+		},
+		{
+			name:        "cert without key",
+			certFile:    certFile,
+			expectError: true,
+		},
+		{
+			name:        "invalid key",
+			certFile:    certFile,
+			keyFile:     garbage,
+			expectError: true,
+		},
+		{
+			name:        "invalid CA",
+			caFile:      garbage,
+			expectError: true,
+		},
+		{
+			name:        "missing CA",
+			caFile:      filepath.Join(dir, "missing"),
+			expectError: true,
+		},
+	}
+
+	for _, test := range tests {
+		creds, err := loadTLSCredentials(test.certFile, test.keyFile, test.caFile)
+		if test.expectError && err == nil {
+			t.Errorf("test %q: Expected error, got none", test.name)
+		}
+		if !test.expectError && err != nil {
+			t.Errorf("test %q: got error: %v", test.name, err)
+		}
+		if test.expectCreds != (creds != nil) {
+			t.Errorf("test %q: expected credentials %t, got %v", test.name, test.expectCreds, creds)
+		}
+	}
+}
@@ -18,6 +18,7 @@ package connection
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net"
 	"strings"
@@ -29,6 +30,8 @@ import (
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/keepalive"
 	"google.golang.org/grpc/status"
 )
 
@@ -39,6 +42,18 @@ type CSIConnection interface {
 	// call.
 	GetDriverName(ctx context.Context) (string, error)
 
+	// GetDriverVersion returns the vendor version of the driver as
+	// discovered by GetPluginInfo() gRPC call.
+	GetDriverVersion(ctx context.Context) (string, error)
+
+	// GetDriverManifest returns the manifest of the driver as
+	// discovered by GetPluginInfo() gRPC call. It may be empty.
+	GetDriverManifest(ctx context.Context) (map[string]string, error)
+
+	// Probe returns true if the driver reports that it is ready to
+	// serve requests, as determined by the Probe() gRPC call.
+	Probe(ctx context.Context) (bool, error)
+
 	// NodeGetId returns node ID of the current according to the CSI driver.
 	NodeGetId(ctx context.Context) (string, error)
 
@@ -46,6 +61,17 @@ type CSIConnection interface {
 	// requires attachment of volumes.
 	IsAttachRequired(ctx context.Context) (bool, error)
 
+	// GetControllerCapabilities returns the RPC capabilities of the
+	// controller service as discovered by ControllerGetCapabilities()
+	// gRPC call.
+	GetControllerCapabilities(ctx context.Context) ([]csi.ControllerServiceCapability_RPC_Type, error)
+
+	// SupportsVolumeAccessibilityConstraints returns true if the
+	// driver reports the VOLUME_ACCESSIBILITY_CONSTRAINTS plugin
+	// capability, i.e. its volumes are not equally accessible from
+	// all nodes.
+	SupportsVolumeAccessibilityConstraints(ctx context.Context) (bool, error)
+
 	// Close the connection
 	Close() error
 }
@@ -58,9 +84,61 @@ var (
 	_ CSIConnection = &csiConnection{}
 )
 
+// ErrEmptyDriverName is returned by GetDriverName when the driver
+// reports an empty or blank name. This is a bug in the driver, so
+// retrying does not help.
+var ErrEmptyDriverName = errors.New("CSI driver reported an empty name")
+
+// CallObserver gets called after each gRPC call to the CSI driver with
+// the full method name, the duration and the result of the call.
+type CallObserver func(method string, duration time.Duration, err error)
+
+// Option changes how NewConnectionWithKeepalive connects.
+type Option func(o *options)
+
+type options struct {
+	observers []CallObserver
+	creds     credentials.TransportCredentials
+}
+
+// WithCallObserver adds an observer for all gRPC calls on the
+// connection.
+func WithCallObserver(observer CallObserver) Option {
+	return func(o *options) {
+		o.observers = append(o.observers, observer)
+	}
+}
+
+// WithTransportCredentials secures the connection, for example with
+// TLS. Without it, the connection is insecure.
+func WithTransportCredentials(creds credentials.TransportCredentials) Option {
+	return func(o *options) {
+		o.creds = creds
+	}
+}
+
 func NewConnection(
 	address string, timeout time.Duration) (CSIConnection, error) {
-	conn, err := connect(address, timeout)
+	return NewConnectionWithKeepalive(address, timeout, 0, 0)
+}
+
+// NewConnectionWithKeepalive is like NewConnection, but additionally
+// sends keepalive pings after keepaliveTime without activity on the
+// connection. If no response arrives within keepaliveTimeout, the
+// connection is considered broken and gRPC re-establishes it in the
+// background, so that pending and future calls fail or get retried
+// instead of hanging. A keepaliveTime of zero disables keepalive.
+//
+// Pings are only sent while a call is active, because CSI drivers using
+// the default gRPC server policy close connections that get pinged
+// while idle.
+func NewConnectionWithKeepalive(
+	address string, timeout, keepaliveTime, keepaliveTimeout time.Duration, opts ...Option) (CSIConnection, error) {
+	var o options
+	for _, opt := range opts {
+		opt(&o)
+	}
+	conn, err := connect(address, timeout, keepaliveTime, keepaliveTimeout, o)
 	if err != nil {
 		return nil, err
 	}
@@ -69,13 +147,24 @@ func NewConnection(
 	}, nil
 }
 
-func connect(address string, timeout time.Duration) (*grpc.ClientConn, error) {
+func connect(address string, timeout, keepaliveTime, keepaliveTimeout time.Duration, o options) (*grpc.ClientConn, error) {
 	glog.V(2).Infof("Connecting to %s", address)
 	dialOptions := []grpc.DialOption{
-		grpc.WithInsecure(),
 		grpc.WithBackoffMaxDelay(time.Second),
-		grpc.WithUnaryInterceptor(logGRPC),
+		grpc.WithUnaryInterceptor(o.interceptor),
 	}
+	if o.creds != nil {
+		dialOptions = append(dialOptions, grpc.WithTransportCredentials(o.creds))
+	} else {
+		dialOptions = append(dialOptions, grpc.WithInsecure())
+	}
+	if keepaliveTime > 0 {
+		dialOptions = append(dialOptions, grpc.WithKeepaliveParams(keepalive.ClientParameters{
+			Time:    keepaliveTime,
+			Timeout: keepaliveTimeout,
+		}))
+	}
+	address = strings.TrimPrefix(address, "unix://")
 	if strings.HasPrefix(address, "/") {
 		dialOptions = append(dialOptions, grpc.WithDialer(func(addr string, timeout time.Duration) (net.Conn, error) {
 			return net.DialTimeout("unix", addr, timeout)
@@ -111,12 +200,58 @@ func (c *csiConnection) GetDriverName(ctx context.Context) (string, error) {
 		return "", err
 	}
 	name := rsp.GetName()
-	if name == "" {
-		return "", fmt.Errorf("name is empty")
+	if strings.TrimSpace(name) == "" {
+		return "", ErrEmptyDriverName
 	}
 	return name, nil
 }
 
+func (c *csiConnection) GetDriverVersion(ctx context.Context) (string, error) {
+	client := csi.NewIdentityClient(c.conn)
+
+	req := csi.GetPluginInfoRequest{}
+
+	rsp, err := client.GetPluginInfo(ctx, &req)
+	if err != nil {
+		return "", err
+	}
+	version := rsp.GetVendorVersion()
+	if version == "" {
+		return "", fmt.Errorf("vendor version is empty")
+	}
+	return version, nil
+}
+
+func (c *csiConnection) GetDriverManifest(ctx context.Context) (map[string]string, error) {
+	client := csi.NewIdentityClient(c.conn)
+
+	req := csi.GetPluginInfoRequest{}
+
+	rsp, err := client.GetPluginInfo(ctx, &req)
+	if err != nil {
+		return nil, err
+	}
+	return rsp.GetManifest(), nil
+}
+
+func (c *csiConnection) Probe(ctx context.Context) (bool, error) {
+	client := csi.NewIdentityClient(c.conn)
+
+	req := csi.ProbeRequest{}
+
+	rsp, err := client.Probe(ctx, &req)
+	if err != nil {
+		return false, err
+	}
+	ready := rsp.GetReady()
+	if ready == nil {
+		// The driver did not report readiness and thus must be
+		// ready, see the CSI spec.
+		return true, nil
+	}
+	return ready.GetValue(), nil
+}
+
 func (c *csiConnection) NodeGetId(ctx context.Context) (string, error) {
 	client := csi.NewNodeClient(c.conn)
 
@@ -134,23 +269,53 @@ func (c *csiConnection) NodeGetId(ctx context.Context) (string, error) {
 }
 
 func (c *csiConnection) IsAttachRequired(ctx context.Context) (bool, error) {
+	caps, err := c.GetControllerCapabilities(ctx)
+	if err != nil {
+		return false, err
+	}
+
+	for _, cap := range caps {
+		if cap == csi.ControllerServiceCapability_RPC_PUBLISH_UNPUBLISH_VOLUME {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+func (c *csiConnection) GetControllerCapabilities(ctx context.Context) ([]csi.ControllerServiceCapability_RPC_Type, error) {
 	client := csi.NewControllerClient(c.conn)
 
 	req := csi.ControllerGetCapabilitiesRequest{}
 
 	rsp, err := client.ControllerGetCapabilities(ctx, &req)
 	if err != nil {
-		return false, err
+		return nil, err
 	}
 
-	caps := rsp.GetCapabilities()
+	var caps []csi.ControllerServiceCapability_RPC_Type
+	for _, cap := range rsp.GetCapabilities() {
+		if rpc := cap.GetRpc(); rpc != nil {
+			caps = append(caps, rpc.GetType())
+		}
+	}
+	return caps, nil
+}
 
-	for _, cap := range caps {
-		if cap.GetRpc().GetType() == csi.ControllerServiceCapability_RPC_PUBLISH_UNPUBLISH_VOLUME {
+func (c *csiConnection) SupportsVolumeAccessibilityConstraints(ctx context.Context) (bool, error) {
+	client := csi.NewIdentityClient(c.conn)
+
+	req := csi.GetPluginCapabilitiesRequest{}
+
+	rsp, err := client.GetPluginCapabilities(ctx, &req)
+	if err != nil {
+		return false, err
+	}
+	for _, cap := range rsp.GetCapabilities() {
+		if cap.GetService().GetType() == csi.PluginCapability_Service_VOLUME_ACCESSIBILITY_CONSTRAINTS {
 			return true, nil
 		}
 	}
-
 	return false, nil
 }
 
@@ -167,6 +332,17 @@ func logGRPC(ctx context.Context, method string, req, reply interface{}, cc *grp
 	return err
 }
 
+// interceptor logs the call and notifies all observers.
+func (o options) interceptor(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	start := time.Now()
+	err := logGRPC(ctx, method, req, reply, cc, invoker, opts...)
+	duration := time.Since(start)
+	for _, observer := range o.observers {
+		observer(method, duration, err)
+	}
+	return err
+}
+
 // isFinished returns true if given error represents final error of an
 // operation. That means the operation has failed completely and cannot be in
 // progress.  It returns false, if the error represents some transient error
@@ -19,10 +19,13 @@ package connection
 import (
 	"context"
 	"fmt"
+	"reflect"
 	"testing"
+	"time"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	"github.com/golang/mock/gomock"
+	"github.com/golang/protobuf/ptypes/wrappers"
 	"github.com/kubernetes-csi/csi-test/driver"
 )
 
@@ -150,6 +153,13 @@ func TestGetPluginInfo(t *testing.T) {
 			},
 			expectError: true,
 		},
+		{
+			name: "blank name",
+			output: &csi.GetPluginInfoResponse{
+				Name: " \t",
+			},
+			expectError: true,
+		},
 	}
 
 	mockController, driver, identityServer, _, _, csiConn, err := createMockServer(t)
@@ -186,6 +196,209 @@ func TestGetPluginInfo(t *testing.T) {
 	}
 }
 
+func TestGetDriverVersion(t *testing.T) {
+	tests := []struct {
+		name        string
+		output      *csi.GetPluginInfoResponse
+		injectError bool
+		expectError bool
+	}{
+		{
+			name: "success",
+			output: &csi.GetPluginInfoResponse{
+				Name:          "csi/example",
+				VendorVersion: "0.2.0",
+			},
+			expectError: false,
+		},
+		{
+			name:        "gRPC error",
+			output:      nil,
+			injectError: true,
+			expectError: true,
+		},
+		{
+			name: "empty version",
+			output: &csi.GetPluginInfoResponse{
+				Name: "csi/example",
+			},
+			expectError: true,
+		},
+	}
+
+	mockController, driver, identityServer, _, _, csiConn, err := createMockServer(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mockController.Finish()
+	defer driver.Stop()
+	defer csiConn.Close()
+
+	for _, test := range tests {
+
+		in := &csi.GetPluginInfoRequest{}
+
+		out := test.output
+		var injectedErr error
+		if test.injectError {
+			injectedErr = fmt.Errorf("mock error")
+		}
+
+		// Setup expectation
+		identityServer.EXPECT().GetPluginInfo(gomock.Any(), in).Return(out, injectedErr).Times(1)
+
+		version, err := csiConn.GetDriverVersion(context.Background())
+		if test.expectError && err == nil {
+			t.Errorf("test %q: Expected error, got none", test.name)
+		}
+		if !test.expectError && err != nil {
+			t.Errorf("test %q: got error: %v", test.name, err)
+		}
+		if err == nil && version != "0.2.0" {
+			t.Errorf("got unexpected version: %q", version)
+		}
+	}
+}
+
+func TestGetDriverManifest(t *testing.T) {
+	tests := []struct {
+		name             string
+		output           *csi.GetPluginInfoResponse
+		injectError      bool
+		expectError      bool
+		expectedManifest map[string]string
+	}{
+		{
+			name: "success",
+			output: &csi.GetPluginInfoResponse{
+				Name:          "csi/example",
+				VendorVersion: "0.2.0",
+				Manifest:      map[string]string{"kubernetes-name": "csi.example.com"},
+			},
+			expectedManifest: map[string]string{"kubernetes-name": "csi.example.com"},
+		},
+		{
+			name: "no manifest",
+			output: &csi.GetPluginInfoResponse{
+				Name: "csi/example",
+			},
+		},
+		{
+			name:        "gRPC error",
+			output:      nil,
+			injectError: true,
+			expectError: true,
+		},
+	}
+
+	mockController, driver, identityServer, _, _, csiConn, err := createMockServer(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mockController.Finish()
+	defer driver.Stop()
+	defer csiConn.Close()
+
+	for _, test := range tests {
+
+		in := &csi.GetPluginInfoRequest{}
+
+		out := test.output
+		var injectedErr error
+		if test.injectError {
+			injectedErr = fmt.Errorf("mock error")
+		}
+
+		// Setup expectation
+		identityServer.EXPECT().GetPluginInfo(gomock.Any(), in).Return(out, injectedErr).Times(1)
+
+		manifest, err := csiConn.GetDriverManifest(context.Background())
+		if test.expectError && err == nil {
+			t.Errorf("test %q: Expected error, got none", test.name)
+		}
+		if !test.expectError && err != nil {
+			t.Errorf("test %q: got error: %v", test.name, err)
+		}
+		if len(manifest) != 0 || len(test.expectedManifest) != 0 {
+			if !reflect.DeepEqual(manifest, test.expectedManifest) {
+				t.Errorf("test %q: expected manifest %v, got %v", test.name, test.expectedManifest, manifest)
+			}
+		}
+	}
+}
+
+func TestProbe(t *testing.T) {
+	tests := []struct {
+		name        string
+		output      *csi.ProbeResponse
+		ready       bool
+		injectError bool
+		expectError bool
+	}{
+		{
+			name: "ready",
+			output: &csi.ProbeResponse{
+				Ready: &wrappers.BoolValue{Value: true},
+			},
+			ready:       true,
+			expectError: false,
+		},
+		{
+			name: "not ready",
+			output: &csi.ProbeResponse{
+				Ready: &wrappers.BoolValue{Value: false},
+			},
+			ready:       false,
+			expectError: false,
+		},
+		{
+			name:        "no readiness",
+			output:      &csi.ProbeResponse{},
+			ready:       true,
+			expectError: false,
+		},
+		{
+			name:        "gRPC error",
+			output:      nil,
+			injectError: true,
+			expectError: true,
+		},
+	}
+
+	mockController, driver, identityServer, _, _, csiConn, err := createMockServer(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mockController.Finish()
+	defer driver.Stop()
+	defer csiConn.Close()
+
+	for _, test := range tests {
+
+		in := &csi.ProbeRequest{}
+
+		out := test.output
+		var injectedErr error
+		if test.injectError {
+			injectedErr = fmt.Errorf("mock error")
+		}
+
+		// Setup expectation
+		identityServer.EXPECT().Probe(gomock.Any(), in).Return(out, injectedErr).Times(1)
+
+		ready, err := csiConn.Probe(context.Background())
+		if test.expectError && err == nil {
+			t.Errorf("test %q: Expected error, got none", test.name)
+		}
+		if !test.expectError && err != nil {
+			t.Errorf("test %q: got error: %v", test.name, err)
+		}
+		if err == nil && ready != test.ready {
+			t.Errorf("test %q: expecting ready == %t, got %t", test.name, test.ready, ready)
+		}
+	}
+}
+
 func TestIsAttachRequired(t *testing.T) {
 	tests := []struct {
 		name           string
@@ -282,3 +495,185 @@ func TestIsAttachRequired(t *testing.T) {
 		}
 	}
 }
+
+func TestSupportsVolumeAccessibilityConstraints(t *testing.T) {
+	serviceCapability := func(t csi.PluginCapability_Service_Type) *csi.PluginCapability {
+		return &csi.PluginCapability{
+			Type: &csi.PluginCapability_Service_{
+				Service: &csi.PluginCapability_Service{
+					Type: t,
+				},
+			},
+		}
+	}
+
+	tests := []struct {
+		name        string
+		output      *csi.GetPluginCapabilitiesResponse
+		topology    bool
+		injectError bool
+		expectError bool
+	}{
+		{
+			name: "topology",
+			output: &csi.GetPluginCapabilitiesResponse{
+				Capabilities: []*csi.PluginCapability{
+					serviceCapability(csi.PluginCapability_Service_CONTROLLER_SERVICE),
+					serviceCapability(csi.PluginCapability_Service_VOLUME_ACCESSIBILITY_CONSTRAINTS),
+				},
+			},
+			topology: true,
+		},
+		{
+			name: "no topology",
+			output: &csi.GetPluginCapabilitiesResponse{
+				Capabilities: []*csi.PluginCapability{
+					serviceCapability(csi.PluginCapability_Service_CONTROLLER_SERVICE),
+					{
+						// Not a service capability, must be skipped.
+					},
+				},
+			},
+			topology: false,
+		},
+		{
+			name:        "gRPC error",
+			output:      nil,
+			injectError: true,
+			expectError: true,
+		},
+	}
+
+	mockController, driver, identityServer, _, _, csiConn, err := createMockServer(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mockController.Finish()
+	defer driver.Stop()
+	defer csiConn.Close()
+
+	for _, test := range tests {
+		var injectedErr error
+		if test.injectError {
+			injectedErr = fmt.Errorf("mock error")
+		}
+		identityServer.EXPECT().GetPluginCapabilities(gomock.Any(), &csi.GetPluginCapabilitiesRequest{}).Return(test.output, injectedErr).Times(1)
+
+		topology, err := csiConn.SupportsVolumeAccessibilityConstraints(context.Background())
+		if test.expectError && err == nil {
+			t.Errorf("test %q: Expected error, got none", test.name)
+		}
+		if !test.expectError && err != nil {
+			t.Errorf("test %q: got error: %v", test.name, err)
+		}
+		if err == nil && topology != test.topology {
+			t.Errorf("test %q: expected topology %t, got %t", test.name, test.topology, topology)
+		}
+	}
+}
+
+func TestKeepalive(t *testing.T) {
+	mockController := gomock.NewController(t)
+	defer mockController.Finish()
+	identityServer := driver.NewMockIdentityServer(mockController)
+	drv := driver.NewMockCSIDriver(&driver.MockCSIDriverServers{
+		Identity: identityServer,
+	})
+	drv.Start()
+	defer drv.Stop()
+
+	csiConn, err := NewConnectionWithKeepalive(drv.Address(), 10, 10*time.Second, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer csiConn.Close()
+
+	out := &csi.GetPluginInfoResponse{Name: "csi/example"}
+	identityServer.EXPECT().GetPluginInfo(gomock.Any(), &csi.GetPluginInfoRequest{}).Return(out, nil).Times(1)
+	name, err := csiConn.GetDriverName(context.Background())
+	if err != nil {
+		t.Errorf("got error: %v", err)
+	}
+	if name != "csi/example" {
+		t.Errorf("got unexpected name: %q", name)
+	}
+}
+
+func TestCallObserver(t *testing.T) {
+	mockController := gomock.NewController(t)
+	defer mockController.Finish()
+	identityServer := driver.NewMockIdentityServer(mockController)
+	drv := driver.NewMockCSIDriver(&driver.MockCSIDriverServers{
+		Identity: identityServer,
+	})
+	drv.Start()
+	defer drv.Stop()
+
+	var methods []string
+	var errs []error
+	observer := func(method string, duration time.Duration, err error) {
+		methods = append(methods, method)
+		errs = append(errs, err)
+	}
+	csiConn, err := NewConnectionWithKeepalive(drv.Address(), 10, 0, 0, WithCallObserver(observer))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer csiConn.Close()
+
+	identityServer.EXPECT().GetPluginInfo(gomock.Any(), gomock.Any()).Return(nil, fmt.Errorf("mock error")).Times(1)
+	csiConn.GetDriverName(context.Background())
+
+	expectedMethods := []string{"/csi.v1.Identity/GetPluginInfo"}
+	if !reflect.DeepEqual(methods, expectedMethods) {
+		t.Errorf("expected methods %v, got %v", expectedMethods, methods)
+	}
+	if len(errs) != 1 || errs[0] == nil {
+		t.Errorf("expected one error, got %v", errs)
+	}
+}
+
+func TestGetControllerCapabilities(t *testing.T) {
+	mockController, driver, _, controllerServer, _, csiConn, err := createMockServer(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mockController.Finish()
+	defer driver.Stop()
+	defer csiConn.Close()
+
+	out := &csi.ControllerGetCapabilitiesResponse{
+		Capabilities: []*csi.ControllerServiceCapability{
+			{
+				Type: &csi.ControllerServiceCapability_Rpc{
+					Rpc: &csi.ControllerServiceCapability_RPC{
+						Type: csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME,
+					},
+				},
+			},
+			{
+				// Not an RPC capability, must be skipped.
+			},
+			{
+				Type: &csi.ControllerServiceCapability_Rpc{
+					Rpc: &csi.ControllerServiceCapability_RPC{
+						Type: csi.ControllerServiceCapability_RPC_LIST_VOLUMES,
+					},
+				},
+			},
+		},
+	}
+	controllerServer.EXPECT().ControllerGetCapabilities(gomock.Any(), &csi.ControllerGetCapabilitiesRequest{}).Return(out, nil).Times(1)
+
+	caps, err := csiConn.GetControllerCapabilities(context.Background())
+	if err != nil {
+		t.Fatalf("got error: %v", err)
+	}
+	expected := []csi.ControllerServiceCapability_RPC_Type{
+		csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME,
+		csi.ControllerServiceCapability_RPC_LIST_VOLUMES,
+	}
+	if !reflect.DeepEqual(caps, expected) {
+		t.Errorf("expected capabilities %v, got %v", expected, caps)
+	}
+}
@@ -0,0 +1,297 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package metrics implements a minimal set of Prometheus metric types
+// and serves them in the Prometheus text exposition format.
+package metrics
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// collector is implemented by all metric types.
+type collector interface {
+	write(w io.Writer)
+}
+
+// Registry holds a set of metrics and serves them via HTTP.
+type Registry struct {
+	mutex      sync.Mutex
+	collectors []collector
+}
+
+var (
+	_ http.Handler = &Registry{}
+)
+
+// NewRegistry creates an empty registry.
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+func (r *Registry) register(c collector) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.collectors = append(r.collectors, c)
+}
+
+// NewCounterVec creates and registers a counter with the given label
+// names.
+func (r *Registry) NewCounterVec(name, help string, labelNames ...string) *CounterVec {
+	c := &CounterVec{
+		desc:       desc{name: name, help: help, kind: "counter"},
+		labelNames: labelNames,
+		series:     map[string]*counterSeries{},
+	}
+	r.register(c)
+	return c
+}
+
+// NewGaugeVec creates and registers a gauge with the given label
+// names.
+func (r *Registry) NewGaugeVec(name, help string, labelNames ...string) *GaugeVec {
+	g := &GaugeVec{
+		desc:       desc{name: name, help: help, kind: "gauge"},
+		labelNames: labelNames,
+		series:     map[string]*gaugeSeries{},
+	}
+	r.register(g)
+	return g
+}
+
+// NewHistogramVec creates and registers a histogram with the given
+// bucket upper bounds, which must be sorted in increasing order, and
+// label names.
+func (r *Registry) NewHistogramVec(name, help string, buckets []float64, labelNames ...string) *HistogramVec {
+	h := &HistogramVec{
+		desc:       desc{name: name, help: help, kind: "histogram"},
+		buckets:    buckets,
+		labelNames: labelNames,
+		series:     map[string]*histogramSeries{},
+	}
+	r.register(h)
+	return h
+}
+
+// ServeHTTP writes all registered metrics in the text format.
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	var buf bytes.Buffer
+	r.mutex.Lock()
+	for _, c := range r.collectors {
+		c.write(&buf)
+	}
+	r.mutex.Unlock()
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.Write(buf.Bytes())
+}
+
+type desc struct {
+	name string
+	help string
+	kind string
+}
+
+func (d desc) writeHeader(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n", d.name, d.help)
+	fmt.Fprintf(w, "# TYPE %s %s\n", d.name, d.kind)
+}
+
+func formatValue(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// CounterVec is a counter with a separate value for each combination
+// of label values.
+type CounterVec struct {
+	desc
+	labelNames []string
+
+	mutex  sync.Mutex
+	series map[string]*counterSeries
+}
+
+type counterSeries struct {
+	labelValues []string
+	value       float64
+}
+
+// Inc increments the counter for the label values by one. There must
+// be one label value per label name.
+func (c *CounterVec) Inc(labelValues ...string) {
+	if len(labelValues) != len(c.labelNames) {
+		panic(fmt.Sprintf("%s: expected %d label values, got %d", c.name, len(c.labelNames), len(labelValues)))
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	key := strings.Join(labelValues, "\xff")
+	s := c.series[key]
+	if s == nil {
+		s = &counterSeries{labelValues: labelValues}
+		c.series[key] = s
+	}
+	s.value++
+}
+
+func (c *CounterVec) write(w io.Writer) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.writeHeader(w)
+	var keys []string
+	for key := range c.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		s := c.series[key]
+		fmt.Fprintf(w, "%s{%s} %s\n", c.name, formatLabels(c.labelNames, s.labelValues), formatValue(s.value))
+	}
+}
+
+// GaugeVec is a gauge with a separate value for each combination of
+// label values.
+type GaugeVec struct {
+	desc
+	labelNames []string
+
+	mutex  sync.Mutex
+	series map[string]*gaugeSeries
+}
+
+type gaugeSeries struct {
+	labelValues []string
+	value       float64
+}
+
+// Set replaces the current value for the label values. There must be
+// one label value per label name.
+func (g *GaugeVec) Set(v float64, labelValues ...string) {
+	if len(labelValues) != len(g.labelNames) {
+		panic(fmt.Sprintf("%s: expected %d label values, got %d", g.name, len(g.labelNames), len(labelValues)))
+	}
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	key := strings.Join(labelValues, "\xff")
+	s := g.series[key]
+	if s == nil {
+		s = &gaugeSeries{labelValues: labelValues}
+		g.series[key] = s
+	}
+	s.value = v
+}
+
+func (g *GaugeVec) write(w io.Writer) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	g.writeHeader(w)
+	var keys []string
+	for key := range g.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		s := g.series[key]
+		fmt.Fprintf(w, "%s{%s} %s\n", g.name, formatLabels(g.labelNames, s.labelValues), formatValue(s.value))
+	}
+}
+
+// HistogramVec counts observations in buckets, separately for each
+// combination of label values.
+type HistogramVec struct {
+	desc
+	buckets    []float64
+	labelNames []string
+
+	mutex  sync.Mutex
+	series map[string]*histogramSeries
+}
+
+type histogramSeries struct {
+	labelValues []string
+	counts      []uint64
+	count       uint64
+	sum         float64
+}
+
+// Observe adds a value. There must be one label value per label name.
+func (h *HistogramVec) Observe(v float64, labelValues ...string) {
+	if len(labelValues) != len(h.labelNames) {
+		panic(fmt.Sprintf("%s: expected %d label values, got %d", h.name, len(h.labelNames), len(labelValues)))
+	}
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	key := strings.Join(labelValues, "\xff")
+	s := h.series[key]
+	if s == nil {
+		s = &histogramSeries{
+			labelValues: labelValues,
+			counts:      make([]uint64, len(h.buckets)),
+		}
+		h.series[key] = s
+	}
+	for i, upperBound := range h.buckets {
+		if v <= upperBound {
+			s.counts[i]++
+		}
+	}
+	s.count++
+	s.sum += v
+}
+
+func (h *HistogramVec) write(w io.Writer) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.writeHeader(w)
+	var keys []string
+	for key := range h.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		s := h.series[key]
+		labels := formatLabels(h.labelNames, s.labelValues)
+		for i, upperBound := range h.buckets {
+			fmt.Fprintf(w, "%s_bucket{%s} %d\n", h.name, withLabel(labels, "le", formatValue(upperBound)), s.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket{%s} %d\n", h.name, withLabel(labels, "le", "+Inf"), s.count)
+		fmt.Fprintf(w, "%s_sum{%s} %s\n", h.name, labels, formatValue(s.sum))
+		fmt.Fprintf(w, "%s_count{%s} %d\n", h.name, labels, s.count)
+	}
+}
+
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatLabels(names, values []string) string {
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		pairs[i] = fmt.Sprintf("%s=\"%s\"", name, labelValueEscaper.Replace(values[i]))
+	}
+	return strings.Join(pairs, ",")
+}
+
+func withLabel(labels, name, value string) string {
+	label := formatLabels([]string{name}, []string{value})
+	if labels == "" {
+		return label
+	}
+	return labels + "," + label
+}
@@ -0,0 +1,118 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package metrics
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestServeHTTP(t *testing.T) {
+	registry := NewRegistry()
+	gauge := registry.NewGaugeVec("test_gauge", "A test gauge.", "name")
+	counter := registry.NewCounterVec("test_total", "A test counter.", "name")
+
+	gauge.Set(1, "a")
+	counter.Inc("a")
+	counter.Inc("a")
+
+	rec := httptest.NewRecorder()
+	registry.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+
+	// Metrics are written in the order in which they were created.
+	expected := `# HELP test_gauge A test gauge.
+# TYPE test_gauge gauge
+test_gauge{name="a"} 1
+# HELP test_total A test counter.
+# TYPE test_total counter
+test_total{name="a"} 2
+`
+	if rec.Body.String() != expected {
+		t.Errorf("expected:\n%s\ngot:\n%s", expected, rec.Body.String())
+	}
+}
+
+func TestCounterVec(t *testing.T) {
+	registry := NewRegistry()
+	counter := registry.NewCounterVec("test_total", "A test counter.", "version")
+
+	counter.Inc("v1")
+	counter.Inc("v1alpha1")
+	counter.Inc("v1")
+
+	rec := httptest.NewRecorder()
+	registry.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+
+	expected := `# HELP test_total A test counter.
+# TYPE test_total counter
+test_total{version="v1"} 2
+test_total{version="v1alpha1"} 1
+`
+	if rec.Body.String() != expected {
+		t.Errorf("expected:\n%s\ngot:\n%s", expected, rec.Body.String())
+	}
+}
+
+func TestGaugeVec(t *testing.T) {
+	registry := NewRegistry()
+	gauge := registry.NewGaugeVec("test_gauge", "A test gauge.", "driver_name")
+
+	gauge.Set(1, "b.example.com")
+	gauge.Set(1, "a.example.com")
+	gauge.Set(0, "b.example.com")
+
+	rec := httptest.NewRecorder()
+	registry.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+
+	expected := `# HELP test_gauge A test gauge.
+# TYPE test_gauge gauge
+test_gauge{driver_name="a.example.com"} 1
+test_gauge{driver_name="b.example.com"} 0
+`
+	if rec.Body.String() != expected {
+		t.Errorf("expected:\n%s\ngot:\n%s", expected, rec.Body.String())
+	}
+}
+
+func TestHistogramVec(t *testing.T) {
+	registry := NewRegistry()
+	histogram := registry.NewHistogramVec("test_seconds", "A test histogram.", []float64{0.1, 1}, "method", "code")
+
+	histogram.Observe(0.05, "/a", "OK")
+	histogram.Observe(0.5, "/a", "OK")
+	histogram.Observe(5, "/b\"", "Unavailable")
+
+	rec := httptest.NewRecorder()
+	registry.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+
+	expected := `# HELP test_seconds A test histogram.
+# TYPE test_seconds histogram
+test_seconds_bucket{method="/a",code="OK",le="0.1"} 1
+test_seconds_bucket{method="/a",code="OK",le="1"} 2
+test_seconds_bucket{method="/a",code="OK",le="+Inf"} 2
+test_seconds_sum{method="/a",code="OK"} 0.55
+test_seconds_count{method="/a",code="OK"} 2
+test_seconds_bucket{method="/b\"",code="Unavailable",le="0.1"} 0
+test_seconds_bucket{method="/b\"",code="Unavailable",le="1"} 0
+test_seconds_bucket{method="/b\"",code="Unavailable",le="+Inf"} 1
+test_seconds_sum{method="/b\"",code="Unavailable"} 5
+test_seconds_count{method="/b\"",code="Unavailable"} 1
+`
+	if rec.Body.String() != expected {
+		t.Errorf("expected:\n%s\ngot:\n%s", expected, rec.Body.String())
+	}
+}